@@ -6,6 +6,7 @@
 package registry
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -30,34 +31,131 @@ type Balancer interface {
 	Stop()
 }
 
+// ContextBalancer is an optional balancer interface
+// which waits the healthy upstream of the service
+type ContextBalancer interface {
+	// BorrowContext service from upstream, waits the next refresh
+	// until the context is done if there is no healthy upstream
+	BorrowContext(ctx context.Context, service string) (Connect, error)
+}
+
+// KeyBalancer is an optional balancer interface
+// of the sticky routing by the key
+type KeyBalancer interface {
+	// BorrowByKey service from upstream by the consistent hash of the key
+	BorrowByKey(service, key string) Connect
+}
+
 type balancer struct {
 	sync.Mutex
-	ticker            *time.Ticker
+	stop              chan bool
+	refreshed         chan bool
 	maxIdelConnection int
 	discovery         service.Discovery
+	strategies        Strategies
+	outlierDetection  OutlierDetection
+	health            *healthMonitor
 	serviceStreams    map[string]*Upstream
 }
 
-// NewBalancer object
-func NewBalancer(discovery service.Discovery, maxIdelConnection int) Balancer {
+// BalancerOptions of the balancer
+type BalancerOptions struct {
+	// MaxIdleConnections in the queue of the upstream
+	MaxIdleConnections int
+
+	// Strategies of upstreams by service names
+	Strategies Strategies
+
+	// OutlierDetection options of hosts of all upstreams
+	OutlierDetection OutlierDetection
+
+	// HealthCheck options of the active checking of hosts of all upstreams,
+	// checks are running with the Supervisor
+	HealthCheck HealthCheck
+}
+
+// NewBalancer object with optional balancing strategies by service names,
+// e.g. Strategies{"": SmoothWeightedRoundRobin, "cache": ConsistentHash}
+func NewBalancer(discovery service.Discovery, maxIdelConnection int, strategies ...Strategies) Balancer {
+	var merged = Strategies{}
+	for _, s := range strategies {
+		for name, f := range s {
+			merged[name] = f
+		}
+	}
+
+	return NewBalancerWithOptions(discovery, BalancerOptions{
+		MaxIdleConnections: maxIdelConnection,
+		Strategies:         merged,
+	})
+}
+
+// NewBalancerWithOptions object
+func NewBalancerWithOptions(discovery service.Discovery, options BalancerOptions) Balancer {
 	if nil == discovery {
 		panic("Undefined discovery service")
 	}
-	return &balancer{
-		maxIdelConnection: maxIdelConnection,
+
+	var b = &balancer{
+		maxIdelConnection: options.MaxIdleConnections,
 		discovery:         discovery,
+		strategies:        options.Strategies,
+		outlierDetection:  options.OutlierDetection,
+		refreshed:         make(chan bool),
 		serviceStreams:    map[string]*Upstream{},
 	}
+
+	if options.HealthCheck.Enabled() {
+		b.health = newHealthMonitor(options.HealthCheck, func() {
+			b.Lock()
+			b.wakeup()
+			b.Unlock()
+		})
+	}
+	return b
 }
 
 // Borrow service from upstream
 func (b *balancer) Borrow(service string) Connect {
+	b.Lock()
+	defer b.Unlock()
+
 	if upst, ok := b.serviceStreams[service]; ok {
 		return upst.Borrow()
 	}
 	return nil
 }
 
+// BorrowByKey service from upstream, requests with the same key go to the same
+// instance, changes of instances remap only keys of added or removed instances
+func (b *balancer) BorrowByKey(service, key string) Connect {
+	b.Lock()
+	defer b.Unlock()
+
+	if upst, ok := b.serviceStreams[service]; ok {
+		return upst.BorrowByKey(key)
+	}
+	return nil
+}
+
+// BorrowContext service from upstream. If the service is unknown or has
+// no healthy upstream then it waits the next refresh until the context is done
+// and returns ErrServiceNotFound or ErrNoHealthyUpstream
+func (b *balancer) BorrowContext(ctx context.Context, service string) (Connect, error) {
+	for {
+		conn, refreshed, err := b.borrow(service)
+		if nil == err {
+			return conn, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-refreshed:
+		}
+	}
+}
+
 // Return connect back to pool
 func (b *balancer) Return(conn Connect, errResult error) {
 	conn.Return(errResult)
@@ -65,21 +163,27 @@ func (b *balancer) Return(conn Connect, errResult error) {
 
 // Supervisor loop
 func (b *balancer) Supervisor(interval time.Duration) {
+	b.Stop()
+
 	b.Lock()
+	var stop = make(chan bool)
+	b.stop = stop
+	b.Unlock()
 
-	if nil != b.ticker {
-		b.ticker.Stop()
-	}
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
 
-	b.ticker = time.NewTicker(interval)
-	b.Unlock()
 	b.Refresh()
 
+	if nil != b.health {
+		go b.health.run(stop)
+	}
+
 	for {
 		select {
-		case <-b.ticker.C:
+		case <-ticker.C:
 			b.Refresh()
-		default:
+		case <-stop:
 			return
 		}
 	}
@@ -88,9 +192,9 @@ func (b *balancer) Supervisor(interval time.Duration) {
 // Stop supervisord
 func (b *balancer) Stop() {
 	b.Lock()
-	if nil != b.ticker {
-		b.ticker.Stop()
-		b.ticker = nil
+	if nil != b.stop {
+		close(b.stop)
+		b.stop = nil
 	}
 	b.Unlock()
 }
@@ -98,10 +202,22 @@ func (b *balancer) Stop() {
 // Refresh current state
 func (b *balancer) Refresh() error {
 	services, err := b.discovery.Lookup(nil)
-	if len(services) < 1 || nil != err {
+	if nil != err {
 		return err
 	}
 
+	b.Lock()
+	defer b.Unlock()
+
+	// Wake up all waiters of the refresh
+	defer b.wakeup()
+
+	// All upstreams are reset even if there are no services,
+	// so removed services are not borrowed anymore
+	if nil != b.health {
+		b.health.update(services)
+	}
+
 	for _, up := range b.serviceStreams {
 		up.Reset()
 	}
@@ -110,10 +226,43 @@ func (b *balancer) Refresh() error {
 		if upstream, ok := b.serviceStreams[srv.Name]; ok {
 			upstream.Update(UpstreamService(srv))
 		} else {
-			upstream = NewUpstream(b.maxIdelConnection)
+			upstream = NewUpstream(b.maxIdelConnection, b.strategies.strategy(srv.Name))
+			upstream.SetOutlierDetection(b.outlierDetection)
+			if nil != b.health {
+				upstream.setHealth(b.health)
+			}
 			upstream.Update(UpstreamService(srv))
 			b.serviceStreams[srv.Name] = upstream
 		}
 	}
+
+	for _, up := range b.serviceStreams {
+		up.Prune()
+	}
 	return nil
 }
+
+// wakeup all waiters of the refresh or of the change of hosts health
+func (b *balancer) wakeup() {
+	close(b.refreshed)
+	b.refreshed = make(chan bool)
+}
+
+// borrow connection or returns the error with the channel
+// which is closed after the next refresh
+func (b *balancer) borrow(service string) (Connect, <-chan bool, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	var upst, ok = b.serviceStreams[service]
+	if !ok {
+		return nil, b.refreshed, ErrServiceNotFound
+	}
+
+	if upst.Healthy() {
+		if conn := upst.Borrow(); nil != conn {
+			return conn, nil, nil
+		}
+	}
+	return nil, b.refreshed, ErrNoHealthyUpstream
+}
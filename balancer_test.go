@@ -0,0 +1,232 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package registry_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	registry "."
+	"github.com/geniusrabbit/registry/service"
+	"github.com/geniusrabbit/registry/storage/memory"
+)
+
+func TestBalancer(t *testing.T) {
+	var (
+		discovery = memory.NewDiscovery()
+		balancer  = registry.NewBalancer(discovery, 10)
+	)
+
+	discovery.Register(service.Options{ID: "api-1", Name: "api", Address: "10.0.0.1:8080"})
+	discovery.Register(service.Options{ID: "api-2", Name: "api", Address: "10.0.0.2:8080"})
+	assert.NoError(t, balancer.Refresh())
+
+	assert.NotNil(t, balancer.Borrow("api"))
+	assert.Nil(t, balancer.Borrow("unknown"))
+
+	discovery.SetStatus("api-1", service.StatusCritical)
+	assert.NoError(t, balancer.Refresh())
+
+	for i := 0; i < 10; i++ {
+		if conn := balancer.Borrow("api"); assert.NotNil(t, conn) {
+			assert.Equal(t, "10.0.0.2:8080", conn.Host())
+		}
+	}
+}
+
+func TestBalancerRefreshEmpty(t *testing.T) {
+	var (
+		discovery   = memory.NewDiscovery()
+		balancer    = registry.NewBalancer(discovery, 10)
+		ctxBalancer = balancer.(registry.ContextBalancer)
+	)
+
+	discovery.Register(service.Options{ID: "api-1", Name: "api", Address: "10.0.0.1:8080"})
+	assert.NoError(t, balancer.Refresh())
+	balancer.Return(balancer.Borrow("api"), nil)
+
+	discovery.Unregister("api-1")
+	assert.NoError(t, balancer.Refresh())
+	assert.Nil(t, balancer.Borrow("api"), "Borrow of removed service")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	_, err := ctxBalancer.BorrowContext(ctx, "api")
+	assert.Equal(t, registry.ErrNoHealthyUpstream, err)
+}
+
+func TestBalancerBorrowContext(t *testing.T) {
+	var (
+		discovery   = memory.NewDiscovery()
+		balancer    = registry.NewBalancer(discovery, 10)
+		ctxBalancer = balancer.(registry.ContextBalancer)
+	)
+
+	discovery.Register(service.Options{ID: "api-1", Name: "api", Address: "10.0.0.1:8080"})
+	discovery.SetStatus("api-1", service.StatusCritical)
+	assert.NoError(t, balancer.Refresh())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	_, err := ctxBalancer.BorrowContext(ctx, "unknown")
+	assert.Equal(t, registry.ErrServiceNotFound, err)
+
+	_, err = ctxBalancer.BorrowContext(ctx, "api")
+	assert.Equal(t, registry.ErrNoHealthyUpstream, err)
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		discovery.SetStatus("api-1", service.StatusPassing)
+		balancer.Refresh()
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	conn, err := ctxBalancer.BorrowContext(ctx, "api")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "10.0.0.1:8080", conn.Host())
+	}
+}
+
+func TestBalancerStrategy(t *testing.T) {
+	var (
+		discovery = memory.NewDiscovery()
+		balancer  = registry.NewBalancer(discovery, 10, registry.Strategies{"api": registry.RoundRobin})
+		hosts     = map[string]int{}
+	)
+
+	discovery.Register(service.Options{ID: "api-1", Name: "api", Address: "10.0.0.1:8080"})
+	discovery.Register(service.Options{ID: "api-2", Name: "api", Address: "10.0.0.2:8080"})
+	assert.NoError(t, balancer.Refresh())
+
+	for i := 0; i < 10; i++ {
+		if conn := balancer.Borrow("api"); assert.NotNil(t, conn) {
+			hosts[conn.Host()]++
+			conn.Return(nil)
+		}
+	}
+	assert.Equal(t, map[string]int{"10.0.0.1:8080": 5, "10.0.0.2:8080": 5}, hosts)
+}
+
+func TestBalancerOutlierPrune(t *testing.T) {
+	var (
+		discovery = memory.NewDiscovery()
+		balancer  = registry.NewBalancerWithOptions(discovery, registry.BalancerOptions{
+			Strategies:       registry.Strategies{"": registry.RoundRobin},
+			OutlierDetection: registry.OutlierDetection{ConsecutiveErrors: 1, BaseEjectionTime: time.Minute},
+		})
+		borrowHosts = func() map[string]bool {
+			var hosts = map[string]bool{}
+			for i := 0; i < 10; i++ {
+				if conn := balancer.Borrow("api"); assert.NotNil(t, conn) {
+					hosts[conn.Host()] = true
+					conn.Return(nil)
+				}
+			}
+			return hosts
+		}
+	)
+
+	discovery.Register(service.Options{ID: "api-1", Name: "api", Address: "10.0.0.1:8080"})
+	discovery.Register(service.Options{ID: "api-2", Name: "api", Address: "10.0.0.2:8080"})
+	assert.NoError(t, balancer.Refresh())
+
+	for i := 0; i < 2; i++ {
+		if conn := balancer.Borrow("api"); conn.Host() == "10.0.0.1:8080" {
+			conn.Return(fmt.Errorf("fail"))
+		} else {
+			conn.Return(nil)
+		}
+	}
+	assert.Equal(t, map[string]bool{"10.0.0.2:8080": true}, borrowHosts(), "Ejected host")
+
+	// The state of the removed host is pruned
+	discovery.Unregister("api-1")
+	assert.NoError(t, balancer.Refresh())
+	discovery.Register(service.Options{ID: "api-1", Name: "api", Address: "10.0.0.1:8080"})
+	assert.NoError(t, balancer.Refresh())
+	assert.Equal(t, map[string]bool{"10.0.0.1:8080": true, "10.0.0.2:8080": true}, borrowHosts(), "Returned host")
+}
+
+func TestBalancerHealthCheck(t *testing.T) {
+	var (
+		failing   int32
+		discovery = memory.NewDiscovery()
+		balancer  = registry.NewBalancerWithOptions(discovery, registry.BalancerOptions{
+			MaxIdleConnections: 10,
+			HealthCheck: registry.HealthCheck{
+				Interval:           time.Millisecond * 10,
+				UnhealthyThreshold: 1,
+			},
+		})
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&failing) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+	)
+	defer server.Close()
+
+	// Address without listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	var closedAddress = listener.Addr().String()
+	listener.Close()
+
+	discovery.Register(service.Options{ID: "api-1", Name: "api", Address: "10.0.0.1:8080",
+		Check: service.CheckInfo{HTTP: server.URL}})
+	discovery.Register(service.Options{ID: "api-2", Name: "api", Address: server.Listener.Addr().String()})
+	discovery.Register(service.Options{ID: "api-3", Name: "api", Address: "10.0.0.3:8080",
+		Check: service.CheckInfo{TCP: closedAddress}})
+
+	assert.NoError(t, balancer.Refresh())
+	assert.Nil(t, balancer.Borrow("api"), "Hosts are not checked yet")
+
+	go balancer.Supervisor(time.Minute)
+	defer balancer.Stop()
+
+	var waitHosts = func(expected ...string) bool {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+			var hosts = map[string]bool{}
+			for i := 0; i < 20; i++ {
+				if conn := balancer.Borrow("api"); nil != conn {
+					hosts[conn.Host()] = true
+				}
+			}
+			if len(hosts) == len(expected) {
+				var ok = true
+				for _, host := range expected {
+					ok = ok && hosts[host]
+				}
+				if ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	assert.True(t, waitHosts("10.0.0.1:8080", server.Listener.Addr().String()), "Unavailable TCP check")
+
+	atomic.StoreInt32(&failing, 1)
+	assert.True(t, waitHosts(server.Listener.Addr().String()), "Failed HTTP check")
+
+	atomic.StoreInt32(&failing, 0)
+	assert.True(t, waitHosts("10.0.0.1:8080", server.Listener.Addr().String()), "Restored HTTP check")
+}
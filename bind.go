@@ -5,30 +5,267 @@
 
 package registry
 
+import (
+	"context"
+	"sync"
+)
+
 type bind struct {
+	mx       sync.Mutex
+	updateMx sync.Mutex
+	heap     *BindHeap
 	storages []Storage
+	conf     interface{}
 	target   bindUpdater
+	layers   map[string][]layerValue
+	sealer   *sealer
+	seq      uint64
+	cancels  []func()
+	closed   bool
+}
+
+// layerValue of the key from one storage,
+// values of secret keys are kept sealed
+type layerValue struct {
+	storage  Storage
+	priority int
+	seq      uint64
+	value    interface{}
 }
 
 func (b *bind) subscribe(storages []Storage) {
 	for _, s := range storages {
-		var sub = true
+		var (
+			st  = s
+			sub = true
+		)
 
 		for _, ss := range b.storages {
-			if ss == s {
+			if ss == st {
 				sub = false
 				break
 			}
 		}
 
-		if sub {
-			s.Subscribe(func(key string, val interface{}) {
-				if nil == b {
-					return
+		if !sub {
+			continue
+		}
+
+		var (
+			batch = func(values map[string]interface{}) {
+				if !b.isClosed() {
+					b.error(b.bindError(st, b.update(st, values)))
+				}
+			}
+			update = func(key string, val interface{}) {
+				batch(map[string]interface{}{key: val})
+			}
+			cancel func()
+		)
+
+		cs, cancelable := st.(CancelableStorage)
+		if bs, ok := st.(BatchStorage); ok {
+			if cancelable {
+				cancel = cs.SubscribeBatchCancelable(batch)
+			} else {
+				bs.SubscribeBatch(batch)
+			}
+		} else if cancelable {
+			cancel = cs.SubscribeCancelable(update)
+		} else {
+			st.Subscribe(update)
+		}
+
+		b.mx.Lock()
+		b.storages = append(b.storages, st)
+		if nil != cancel {
+			b.cancels = append(b.cancels, cancel)
+		}
+		b.mx.Unlock()
+	}
+}
+
+// close removes subscriptions of the bind, updates from storages
+// which don't support cancellation are ignored after the close
+func (b *bind) close() {
+	b.mx.Lock()
+	var cancels = b.cancels
+	b.cancels, b.closed = nil, true
+	b.mx.Unlock()
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
+
+func (b *bind) isClosed() bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.closed
+}
+
+// load current values from all storages which support it
+func (b *bind) load(ctx context.Context, storages []Storage) error {
+	for _, s := range storages {
+		loader, ok := s.(Loader)
+		if !ok {
+			continue
+		}
+
+		data, err := loader.Load(ctx)
+		if nil != err {
+			return BindError{Storage: s, Target: b.conf, Err: err}
+		}
+
+		if err = b.update(s, data); nil != err {
+			return b.bindError(s, err)
+		}
+	}
+	return nil
+}
+
+// update the batch of values from the storage. Values are applied
+// only if the storage has the highest priority for the key,
+// the batch is applied as a unit if the target supports it.
+// Layers of keys are restored if the batch is rejected.
+func (b *bind) update(s Storage, values map[string]interface{}) (err error) {
+	b.updateMx.Lock()
+	defer b.updateMx.Unlock()
+
+	var effective, previous = b.layerUpdate(s, values)
+
+	// Values of secret keys are opened only to be applied
+	if err = b.open(effective); nil == err {
+		if up, ok := b.target.(bindBatchUpdater); ok {
+			err = up.UpdateKeys(effective)
+		} else {
+			for key, val := range effective {
+				if err = b.target.UpdateKey(key, val); nil != err {
+					break
+				}
+			}
+		}
+	}
+
+	if nil != err {
+		b.restoreLayers(previous)
+	}
+	return err
+}
+
+// layerUpdate stores values of the storage and returns effective values of keys
+// with previous layers of these keys
+func (b *bind) layerUpdate(s Storage, values map[string]interface{}) (effective map[string]interface{}, previous map[string][]layerValue) {
+	var (
+		priority   = b.heap.priority(s)
+		secrets, _ = b.target.(bindSecretChecker)
+	)
+	effective = make(map[string]interface{}, len(values))
+	previous = make(map[string][]layerValue, len(values))
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if nil == b.layers {
+		b.layers = map[string][]layerValue{}
+	}
+
+	for key, val := range values {
+		previous[key] = b.layers[key]
+
+		var layers = b.layers[key][:0:0]
+		for _, l := range b.layers[key] {
+			if l.storage != s {
+				layers = append(layers, l)
+			}
+		}
+
+		if nil != val {
+			if nil != secrets && secrets.isSecret(key) {
+				if nil == b.sealer {
+					b.sealer = newSealer()
 				}
-				b.target.UpdateKey(key, val)
-			})
-			b.storages = append(b.storages, s)
-		} // end if
+				val = b.sealer.seal(val)
+			}
+			b.seq++
+			layers = append(layers, layerValue{storage: s, priority: priority, seq: b.seq, value: val})
+		}
+
+		if len(layers) > 0 {
+			b.layers[key] = layers
+			effective[key] = topLayer(layers).value
+		} else {
+			delete(b.layers, key)
+			effective[key] = nil
+		}
+	}
+	return effective, previous
+}
+
+// open sealed values of secret keys, it's called under the update lock
+func (b *bind) open(values map[string]interface{}) (err error) {
+	for key, val := range values {
+		if sealed, ok := val.(sealedValue); ok {
+			if values[key], err = b.sealer.open(sealed); nil != err {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restoreLayers of keys after the rejected update
+func (b *bind) restoreLayers(previous map[string][]layerValue) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	for key, layers := range previous {
+		if len(layers) > 0 {
+			b.layers[key] = layers
+		} else {
+			delete(b.layers, key)
+		}
+	}
+}
+
+// source storage of the current value of the key
+func (b *bind) source(key string) Storage {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if layers := b.layers[key]; len(layers) > 0 {
+		return topLayer(layers).storage
+	}
+	return nil
+}
+
+// bindError fills the error with information about the storage and the target
+func (b *bind) bindError(s Storage, err error) error {
+	if nil == err {
+		return nil
+	}
+	bindErr, ok := err.(BindError)
+	if !ok {
+		bindErr = BindError{Err: err}
+	}
+	bindErr.Storage, bindErr.Target = s, b.conf
+	return bindErr
+}
+
+// error sends the update error to the heap handlers
+func (b *bind) error(err error) {
+	if nil != err && nil != b.heap {
+		b.heap.error(err.(BindError))
+	}
+}
+
+// topLayer with the highest priority, the latest updated
+// value wins between storages with the same priority
+func topLayer(layers []layerValue) (top layerValue) {
+	for i, l := range layers {
+		if i == 0 || l.priority > top.priority || (l.priority == top.priority && l.seq > top.seq) {
+			top = l
+		}
 	}
+	return
 }
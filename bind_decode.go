@@ -0,0 +1,66 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package registry
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Value formats of the field tag option `format`
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// isDecodable returns true if the value of the type must be decoded from the raw data
+func isDecodable(tp reflect.Type, format string) bool {
+	if format != "" {
+		return true
+	}
+	tp = reflect.PtrTo(tp)
+	return tp.Implements(textUnmarshalerType) || tp.Implements(jsonUnmarshalerType)
+}
+
+// decodeValue from the raw data into the target pointer
+func decodeValue(target interface{}, data []byte, format string) error {
+	switch format {
+	case FormatJSON:
+		return json.Unmarshal(data, target)
+	case FormatYAML, "yml":
+		return yaml.Unmarshal(data, target)
+	case "":
+	default:
+		return ErrUnsupportedFormat
+	}
+
+	switch v := target.(type) {
+	case encoding.TextUnmarshaler:
+		return v.UnmarshalText(data)
+	case json.Unmarshaler:
+		return v.UnmarshalJSON(data)
+	}
+	return ErrUnsupportedFormat
+}
+
+// rawValue returns bytes of the string value
+func rawValue(value interface{}) ([]byte, bool) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), true
+	case []byte:
+		return v, true
+	}
+	return nil, false
+}
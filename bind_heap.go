@@ -5,25 +5,87 @@
 
 package registry
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
 
 // BindHeap base type
 type BindHeap struct {
-	storages []Storage
-	binds    []bind
+	mx            sync.RWMutex
+	storages      []Storage
+	priorities    map[Storage]int
+	binds         map[interface{}]*bind
+	decrypter     Decrypter
+	errorHandlers []func(err BindError)
 }
 
-// RegisterStore in heap
-func (bh *BindHeap) RegisterStore(st Storage) {
+// RegisterStore in heap with optional priority.
+// Values of the storage with higher priority can't be overwritten
+// by storages with lower priority, the default priority is 0.
+// Between storages with the same priority the last update wins.
+func (bh *BindHeap) RegisterStore(st Storage, priority ...int) {
+	bh.mx.Lock()
 	bh.storages = append(bh.storages, st)
+	if len(priority) > 0 {
+		if nil == bh.priorities {
+			bh.priorities = map[Storage]int{}
+		}
+		bh.priorities[st] = priority[0]
+	}
+	bh.mx.Unlock()
+
+	if reporter, ok := st.(ErrorReporter); ok {
+		reporter.OnError(func(err error) {
+			bh.error(BindError{Storage: st, Err: err})
+		})
+	}
 }
 
-// Bind config for authoupdate
+// SetDecrypter of values of fields with the tag option `secret`
+// for configs which will be bound after the call
+func (bh *BindHeap) SetDecrypter(d Decrypter) {
+	bh.mx.Lock()
+	bh.decrypter = d
+	bh.mx.Unlock()
+}
+
+// Bind config for authoupdate.
+// Default values from the field tags are applied before the subscription.
+// If some required keys have no value after the first sync of storages
+// then *RequiredKeysError is returned. The config can be bound to the heap
+// only once until Unbind, the config is not bound if the error is returned.
 func (bh *BindHeap) Bind(conf interface{}, sep ...string) error {
-	var bn bind
+	return bh.bind(context.Background(), false, false, conf, sep...)
+}
+
+// BindAndLoad config for authoupdate and fill it by current values
+// of all registered storages which support Loader interface before return.
+// If some required keys have no value after the load then *RequiredKeysError
+// is returned and the config is not bound, so the bind can be retried.
+func (bh *BindHeap) BindAndLoad(ctx context.Context, conf interface{}, sep ...string) error {
+	return bh.bind(ctx, true, false, conf, sep...)
+}
+
+// BindAtomic config in the safe access mode. The config is filled like
+// with BindAndLoad but after return it's never changed, all updates are
+// applied to the new copy of the config which is available by Snapshot
+func (bh *BindHeap) BindAtomic(ctx context.Context, conf interface{}, sep ...string) error {
+	return bh.bind(ctx, true, true, conf, sep...)
+}
+
+func (bh *BindHeap) bind(ctx context.Context, load, atomic bool, conf interface{}, sep ...string) (err error) {
+	var bn *bind
+
+	if nil == conf || !reflect.TypeOf(conf).Comparable() {
+		return ErrInvalidTargetStruct
+	}
 
 	if i, ok := conf.(bindUpdater); ok {
-		bn = bind{target: i}
+		bn = &bind{heap: bh, conf: conf, target: i}
 	} else {
 		var (
 			tagName = "store"
@@ -38,14 +100,69 @@ func (bh *BindHeap) Bind(conf interface{}, sep ...string) error {
 			pathSep = rune(sep[1][0])
 		}
 
-		bn = bind{
+		bn = &bind{
+			heap:   bh,
+			conf:   conf,
 			target: WrapConf(conf, tagName, pathSep),
 		}
 	}
 
-	bh.binds = append(bh.binds, bn)
-	bn.subscribe(bh.storages)
+	// Reserve the config to prevent the concurrent bind of the same config
+	bh.mx.Lock()
+	if _, ok := bh.binds[conf]; ok {
+		bh.mx.Unlock()
+		return ErrAlreadyBindedConfig
+	}
+	if nil == bh.binds {
+		bh.binds = map[interface{}]*bind{}
+	}
+	bh.binds[conf] = bn
+	var (
+		storages  = bh.storages
+		decrypter = bh.decrypter
+	)
+	bh.mx.Unlock()
+
+	defer func() {
+		if nil != err {
+			bh.unbind(conf)
+		}
+	}()
+
+	var wrapper, _ = bn.target.(*bindWrapper)
+	if nil != wrapper {
+		wrapper.setDecrypter(decrypter)
+		if err = wrapper.applyDefaults(); nil != err {
+			return err
+		}
+	}
+
+	if load {
+		if err = bn.load(ctx, storages); nil != err {
+			return err
+		}
+	}
 
+	bn.subscribe(storages)
+
+	if nil != wrapper {
+		if keys := wrapper.missingKeys(); len(keys) > 0 {
+			return &RequiredKeysError{Keys: keys}
+		}
+	}
+
+	if nil != wrapper && atomic {
+		wrapper.setAtomic()
+	}
+	return nil
+}
+
+// Unbind config, the config is not updated anymore and subscriptions
+// of storages which support CancelableStorage interface are removed
+func (bh *BindHeap) Unbind(conf interface{}) error {
+	if !bh.unbind(conf) {
+		return ErrUnbindedConfig
+	}
 	return nil
 }
 
@@ -67,31 +184,152 @@ func (bh *BindHeap) Unsubscribe(conf interface{}, key string, b bindKeyUpdater)
 	return ErrUnbindedConfig
 }
 
+// Source returns the storage which supplied the current value of the key,
+// or nil if the key has no value from storages
+func (bh *BindHeap) Source(conf interface{}, key string) Storage {
+	if bn := bh.confBind(conf); nil != bn {
+		return bn.source(key)
+	}
+	return nil
+}
+
+// OnError registers the handler of errors which happen in registered
+// storages or when storage updates are applied to bound configs
+func (bh *BindHeap) OnError(h func(err BindError)) {
+	bh.mx.Lock()
+	bh.errorHandlers = append(bh.errorHandlers, h)
+	bh.mx.Unlock()
+}
+
+// OnChange registers the handler of config changes which is called once
+// per applied update or batch with the list of changed keys
+func (bh *BindHeap) OnChange(conf interface{}, h func(conf interface{}, keys []string)) error {
+	if bw, _ := bh.confUpdater(conf).(*bindWrapper); nil != bw {
+		bw.OnChange(h)
+		return nil
+	}
+	return ErrUnbindedConfig
+}
+
+// Snapshot returns the last consistent copy of the bound config
+// of the same type as conf, or nil if config is not bound
+func (bh *BindHeap) Snapshot(conf interface{}) interface{} {
+	if bw, _ := bh.confUpdater(conf).(*bindWrapper); nil != bw {
+		return bw.Snapshot()
+	}
+	return nil
+}
+
+// Dump returns the flattened view of the last consistent copy of the bound
+// config with states of keys and storages which supplied values.
+// The source is the name of NamedStorage or the type of the storage
+// with the index of registration like `*consul.Storage#1`.
+func (bh *BindHeap) Dump(conf interface{}) (ConfigDump, error) {
+	var bn = bh.confBind(conf)
+	if nil == bn {
+		return nil, ErrUnbindedConfig
+	}
+
+	bw, _ := bn.target.(*bindWrapper)
+	if nil == bw {
+		return nil, ErrUnbindedConfig
+	}
+
+	var dump = bw.dump()
+	for i, item := range dump {
+		if st := bn.source(item.Key); nil != st {
+			dump[i].Source = bh.storageName(st)
+		}
+	}
+	return dump, nil
+}
+
 // Supervisor of auto refresh
 func (bh *BindHeap) Supervisor(interval time.Duration) {
-	for _, st := range bh.storages {
+	bh.mx.RLock()
+	var storages = bh.storages
+	bh.mx.RUnlock()
+
+	for _, st := range storages {
 		go st.Supervisor(interval)
 	}
 }
 
-func (bh *BindHeap) confUpdater(conf interface{}) bindUpdater {
-	for _, bn := range bh.binds {
-		if bn.target == conf {
-			return bn.target
-		}
+// storageName for dumps of configs
+func (bh *BindHeap) storageName(st Storage) string {
+	if named, ok := st.(NamedStorage); ok {
+		return named.Name()
+	}
+
+	bh.mx.RLock()
+	defer bh.mx.RUnlock()
 
-		if bw, _ := bn.target.(*bindWrapper); nil != bw {
-			if bw.target == conf {
-				return bw
-			}
+	for i, s := range bh.storages {
+		if s == st {
+			return fmt.Sprintf("%T#%d", st, i)
 		}
 	}
+	return fmt.Sprintf("%T", st)
+}
+
+func (bh *BindHeap) error(err BindError) {
+	bh.mx.RLock()
+	var handlers = bh.errorHandlers
+	bh.mx.RUnlock()
+
+	for _, h := range handlers {
+		h(err)
+	}
+}
+
+func (bh *BindHeap) priority(st Storage) int {
+	bh.mx.RLock()
+	defer bh.mx.RUnlock()
+	return bh.priorities[st]
+}
+
+func (bh *BindHeap) confUpdater(conf interface{}) bindUpdater {
+	if bn := bh.confBind(conf); nil != bn {
+		return bn.target
+	}
 	return nil
 }
 
-// RegisterStore in heap
-func RegisterStore(st Storage) {
-	DefaultBindHeap.RegisterStore(st)
+func (bh *BindHeap) confBind(conf interface{}) *bind {
+	if nil == conf || !reflect.TypeOf(conf).Comparable() {
+		return nil
+	}
+
+	bh.mx.RLock()
+	defer bh.mx.RUnlock()
+	return bh.binds[conf]
+}
+
+// unbind config and close its subscriptions, returns false if the config is not bound
+func (bh *BindHeap) unbind(conf interface{}) bool {
+	if nil == conf || !reflect.TypeOf(conf).Comparable() {
+		return false
+	}
+
+	bh.mx.Lock()
+	var bn, ok = bh.binds[conf]
+	delete(bh.binds, conf)
+	bh.mx.Unlock()
+
+	if ok {
+		bn.close()
+	}
+	return ok
+}
+
+// RegisterStore in heap with optional priority
+func RegisterStore(st Storage, priority ...int) {
+	DefaultBindHeap.RegisterStore(st, priority...)
+}
+
+// SetDecrypter of values of secret fields
+func SetDecrypter(d Decrypter) {
+	DefaultBindHeap.SetDecrypter(d)
 }
 
 // Bind config for authoupdate
@@ -99,6 +337,46 @@ func Bind(conf interface{}, sep ...string) error {
 	return DefaultBindHeap.Bind(conf, sep...)
 }
 
+// BindAndLoad config for authoupdate and fill it by current values
+func BindAndLoad(ctx context.Context, conf interface{}, sep ...string) error {
+	return DefaultBindHeap.BindAndLoad(ctx, conf, sep...)
+}
+
+// BindAtomic config in the safe access mode
+func BindAtomic(ctx context.Context, conf interface{}, sep ...string) error {
+	return DefaultBindHeap.BindAtomic(ctx, conf, sep...)
+}
+
+// Source returns the storage which supplied the current value of the key
+func Source(conf interface{}, key string) Storage {
+	return DefaultBindHeap.Source(conf, key)
+}
+
+// OnError registers the handler of config update errors
+func OnError(h func(err BindError)) {
+	DefaultBindHeap.OnError(h)
+}
+
+// OnChange registers the handler of config changes
+func OnChange(conf interface{}, h func(conf interface{}, keys []string)) error {
+	return DefaultBindHeap.OnChange(conf, h)
+}
+
+// Snapshot returns the last consistent copy of the bound config
+func Snapshot(conf interface{}) interface{} {
+	return DefaultBindHeap.Snapshot(conf)
+}
+
+// Dump returns the flattened view of the bound config
+func Dump(conf interface{}) (ConfigDump, error) {
+	return DefaultBindHeap.Dump(conf)
+}
+
+// Unbind config
+func Unbind(conf interface{}) error {
+	return DefaultBindHeap.Unbind(conf)
+}
+
 // Subscribe updater for config
 func Subscribe(conf interface{}, key string, b bindKeyUpdater) error {
 	return DefaultBindHeap.Subscribe(conf, key, b)
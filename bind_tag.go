@@ -0,0 +1,50 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package registry
+
+import "strings"
+
+// tagOptions of the bind field
+//
+// Format: `store:"service/port,default=8080,required"`
+// or `store:"service/limits,format=json"`
+// or `store:"db/password,secret"`
+type tagOptions struct {
+	path         string
+	defaultValue *string
+	required     bool
+	secret       bool
+	format       string
+}
+
+func parseTag(tag string) (opts tagOptions) {
+	var parts = strings.Split(tag, ",")
+	opts.path = strings.TrimSpace(parts[0])
+
+	for _, opt := range parts[1:] {
+		var name, value = opt, ""
+		if idx := strings.IndexByte(opt, '='); idx >= 0 {
+			name, value = opt[:idx], opt[idx+1:]
+		}
+
+		switch strings.TrimSpace(name) {
+		case "default":
+			opts.defaultValue = &value
+		case "required":
+			opts.required = true
+		case "secret":
+			opts.secret = true
+		case "format":
+			opts.format = strings.ToLower(strings.TrimSpace(value))
+		}
+	}
+	return
+}
+
+// hasDefault value of the field
+func (opts tagOptions) hasDefault() bool {
+	return nil != opts.defaultValue
+}
@@ -6,13 +6,22 @@
 package registry_test
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
 	"io"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	registry "."
+	"github.com/geniusrabbit/registry/service"
+	"github.com/geniusrabbit/registry/storage/memory"
 )
 
 type conf struct {
@@ -20,6 +29,12 @@ type conf struct {
 	IP      string `store:"service/ip"`
 }
 
+type confOptions struct {
+	Service string `store:"service/name,required"`
+	Port    int    `store:"service/port,default=8080"`
+	Token   string `store:"service/token,required"`
+}
+
 type store struct {
 	fn func(key string, value interface{})
 }
@@ -40,8 +55,129 @@ func (s *store) Supervisor(interval time.Duration) {
 	// Doommy...
 }
 
+type tokenStore struct {
+	store
+}
+
+func (s *tokenStore) Subscribe(f func(key string, value interface{})) {
+	s.fn = f
+	s.fn("service/token", "secret")
+}
+
+type namedStore struct {
+	store
+}
+
+func (s *namedStore) Name() string {
+	return "named"
+}
+
+type loadStore struct {
+	store
+	values map[string]interface{}
+}
+
+func (s *loadStore) Subscribe(f func(key string, value interface{})) {
+	s.fn = f
+}
+
+func (s *loadStore) Load(ctx context.Context) (map[string]interface{}, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	return s.values, nil
+}
+
+type batchStore struct {
+	store
+	batch func(values map[string]interface{})
+}
+
+func (s *batchStore) SubscribeBatch(f func(values map[string]interface{})) {
+	s.batch = f
+}
+
+type confDB struct {
+	Host     string `store:"db/host"`
+	Port     int    `store:"db/port"`
+	Password string `store:"db/password"`
+}
+
+type confKept struct {
+	sync.Mutex
+	Name string `store:"service/name"`
+	DB   *struct {
+		Host string `store:"host"`
+	} `store:"db"`
+	State string
+}
+
+type confValidated struct {
+	Port int `store:"service/port"`
+}
+
+func (c *confValidated) Validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	return nil
+}
+
+type confNested struct {
+	Features map[string]bool `store:"features"`
+	Hosts    []string        `store:"hosts"`
+	Tenants  map[string]struct {
+		Name  string `store:"name"`
+		Limit int    `store:"limit"`
+	} `store:"tenants"`
+	DB *struct {
+		Host string `store:"host"`
+		Port int    `store:"port"`
+	} `store:"db"`
+	Service struct {
+		Listen string `store:"service/listen"`
+	}
+}
+
+type confDecoded struct {
+	Limits struct {
+		RPS   int `json:"rps"`
+		Burst int `json:"burst"`
+	} `store:"service/limits,format=json"`
+	Routes  map[string]string `store:"service/routes,format=yaml"`
+	Started time.Time         `store:"service/started"`
+}
+
+type confRequiredDecoded struct {
+	Limits struct {
+		RPS int `json:"rps"`
+	} `store:"service/limits,format=json,required"`
+	Started time.Time `store:"service/started,required"`
+}
+
+type confSecret struct {
+	User     string `store:"db/user"`
+	Password string `store:"db/password,secret"`
+	Port     int    `store:"db/port,secret"`
+}
+
 type keyUpdater struct{}
 
+type keyDeleter struct {
+	deleted []string
+}
+
+func (kd *keyDeleter) ConfigKeyUpdate(target interface{}, key string, value interface{}) error {
+	return nil
+}
+
+func (kd *keyDeleter) ConfigKeyDelete(target interface{}, key string) error {
+	kd.deleted = append(kd.deleted, key)
+	return nil
+}
+
 func (ku *keyUpdater) ConfigKeyUpdate(target interface{}, key string, value interface{}) error {
 	if key == "service/ip" {
 		target.(*conf).IP = "192.168.0.1"
@@ -50,6 +186,21 @@ func (ku *keyUpdater) ConfigKeyUpdate(target interface{}, key string, value inte
 	return nil
 }
 
+// keyOnce unsubscribes itself after the first update
+type keyOnce struct {
+	heap    *registry.BindHeap
+	conf    interface{}
+	updates int
+}
+
+func (ko *keyOnce) ConfigKeyUpdate(target interface{}, key string, value interface{}) error {
+	ko.updates++
+	if _, err := ko.heap.Dump(ko.conf); nil != err {
+		return err
+	}
+	return ko.heap.Unsubscribe(ko.conf, "service", ko)
+}
+
 func TestBind(t *testing.T) {
 	var (
 		st         = &store{}
@@ -78,3 +229,570 @@ func TestBind(t *testing.T) {
 	st.fn("service/ip", "127.0.0.1")
 	assert.True(t, "127.0.0.1" == conf.IP, "Invalid ip4 address")
 }
+
+func TestBindSubscriberUsesHeap(t *testing.T) {
+	var (
+		heap registry.BindHeap
+		st   = &store{}
+		cnf  = &conf{}
+		once = &keyOnce{heap: &heap, conf: cnf}
+	)
+	heap.RegisterStore(st)
+	assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+	assert.NoError(t, heap.Subscribe(cnf, "service", once), "Subscribe")
+
+	st.fn("service/ip", "127.0.0.2")
+	st.fn("service/ip", "127.0.0.3")
+	assert.True(t, "127.0.0.3" == cnf.IP, "Invalid ip address")
+	assert.True(t, 1 == once.updates, "Subscriber must be removed")
+}
+
+func TestBindDelete(t *testing.T) {
+	var (
+		heap       registry.BindHeap
+		st         = &store{}
+		conf       = &conf{}
+		keyDeleter = &keyDeleter{}
+	)
+	heap.RegisterStore(st)
+	assert.NoError(t, heap.Bind(conf, "store", "/"), "Bind")
+	assert.NoError(t, heap.Subscribe(conf, "service", keyDeleter), "Subscribe")
+
+	st.fn("service/ip", nil)
+	assert.True(t, "" == conf.IP, "IP address must be reset")
+	assert.True(t, "test" == conf.Service, "Invalid service name")
+	assert.True(t, len(keyDeleter.deleted) == 1 && keyDeleter.deleted[0] == "service/ip", "Delete event")
+
+	st.fn("service/ip", "127.0.0.3")
+	assert.True(t, "127.0.0.3" == conf.IP, "Invalid ip address after restore")
+}
+
+func TestBindTagOptions(t *testing.T) {
+	var (
+		heap registry.BindHeap
+		st   = &store{}
+		conf = &confOptions{}
+	)
+	heap.RegisterStore(st)
+
+	err := heap.Bind(conf, "store", "/")
+	if assert.Error(t, err, "Required key error") {
+		reqErr, _ := err.(*registry.RequiredKeysError)
+		assert.True(t, nil != reqErr && len(reqErr.Keys) == 1 && reqErr.Keys[0] == "service/token", "Missing keys")
+	}
+	assert.True(t, "test" == conf.Service, "Invalid service name")
+	assert.True(t, 8080 == conf.Port, "Invalid default port")
+
+	// The config is not bound after the error and the bind can be retried
+	heap.RegisterStore(&tokenStore{})
+	assert.NoError(t, heap.Bind(conf, "store", "/"), "Retry bind")
+	assert.True(t, "secret" == conf.Token, "Invalid token")
+
+	st.fn("service/port", "9090")
+	assert.True(t, 9090 == conf.Port, "Invalid port")
+
+	st.fn("service/port", nil)
+	assert.True(t, 8080 == conf.Port, "Port must be reset to default")
+}
+
+func TestBindAndLoad(t *testing.T) {
+	var (
+		heap registry.BindHeap
+		st   = &loadStore{values: map[string]interface{}{
+			"service/name":  "test",
+			"service/port":  "9090",
+			"service/token": "secret",
+		}}
+		conf = &confOptions{}
+	)
+	heap.RegisterStore(st)
+
+	assert.NoError(t, heap.BindAndLoad(context.Background(), conf, "store", "/"), "BindAndLoad")
+	assert.True(t, "test" == conf.Service, "Invalid service name")
+	assert.True(t, 9090 == conf.Port, "Invalid port")
+	assert.True(t, "secret" == conf.Token, "Invalid token")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, heap.BindAndLoad(ctx, &confOptions{}, "store", "/"), "Canceled load")
+
+	// The config is not bound after the error and the bind can be retried
+	conf = &confOptions{}
+	delete(st.values, "service/token")
+	err := heap.BindAndLoad(context.Background(), conf, "store", "/")
+	if assert.Error(t, err, "Required key error") {
+		reqErr, _ := err.(*registry.RequiredKeysError)
+		assert.True(t, nil != reqErr && len(reqErr.Keys) == 1 && reqErr.Keys[0] == "service/token", "Missing keys")
+	}
+
+	st.values["service/token"] = "secret"
+	assert.NoError(t, heap.BindAndLoad(context.Background(), conf, "store", "/"), "Retry BindAndLoad")
+	assert.True(t, "secret" == conf.Token, "Invalid token after retry")
+}
+
+func TestBindAtomic(t *testing.T) {
+	var (
+		wg   sync.WaitGroup
+		heap registry.BindHeap
+		st   = &store{}
+		cnf  = &conf{}
+	)
+	heap.RegisterStore(st)
+
+	assert.NoError(t, heap.BindAtomic(context.Background(), cnf, "store", "/"), "BindAtomic")
+	assert.True(t, "test" == cnf.Service, "Invalid service name")
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			snap := heap.Snapshot(cnf).(*conf)
+			assert.True(t, "test" == snap.Service, "Invalid snapshot service name")
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		st.fn("service/ip", fmt.Sprintf("127.0.0.%d", i%255))
+	}
+	wg.Wait()
+
+	st.fn("service/ip", "127.0.0.5")
+	assert.True(t, "127.0.0.1" == cnf.IP, "Bound config must not be changed")
+	assert.True(t, "127.0.0.5" == heap.Snapshot(cnf).(*conf).IP, "Invalid snapshot ip address")
+}
+
+func TestBindBatch(t *testing.T) {
+	var (
+		heap    registry.BindHeap
+		st      = &batchStore{}
+		cnf     = &confDB{}
+		changes [][]string
+	)
+	heap.RegisterStore(st)
+
+	assert.NoError(t, heap.BindAtomic(context.Background(), cnf, "store", "/"), "BindAtomic")
+	assert.NoError(t, heap.OnChange(cnf, func(conf interface{}, keys []string) {
+		changes = append(changes, keys)
+	}), "OnChange")
+
+	st.batch(map[string]interface{}{
+		"db/host":     "db.local",
+		"db/port":     "5432",
+		"db/password": "secret",
+	})
+	snap := heap.Snapshot(cnf).(*confDB)
+	assert.True(t, "db.local" == snap.Host && 5432 == snap.Port && "secret" == snap.Password, "Invalid batch update")
+	assert.Equal(t, [][]string{{"db/host", "db/password", "db/port"}}, changes)
+
+	// Invalid batch must not be applied partially
+	st.batch(map[string]interface{}{
+		"db/host": "db2.local",
+		"db/port": "invalid",
+	})
+	snap = heap.Snapshot(cnf).(*confDB)
+	assert.True(t, "db.local" == snap.Host && 5432 == snap.Port, "Batch must not be applied")
+	assert.True(t, len(changes) == 1, "Change handler must not be called")
+
+	st.batch(map[string]interface{}{
+		"db/host": "db2.local",
+		"db/port": "5433",
+	})
+	snap = heap.Snapshot(cnf).(*confDB)
+	assert.True(t, "db2.local" == snap.Host && 5433 == snap.Port, "Invalid batch update after fail")
+}
+
+func TestBindBatchNotAtomic(t *testing.T) {
+	var (
+		heap   registry.BindHeap
+		st     = &batchStore{}
+		cnf    = &confDB{}
+		errors []registry.BindError
+	)
+	heap.RegisterStore(st)
+	heap.OnError(func(err registry.BindError) { errors = append(errors, err) })
+	assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+
+	st.batch(map[string]interface{}{"db/host": "h1", "db/port": "5432"})
+	assert.True(t, "h1" == cnf.Host && 5432 == cnf.Port, "Invalid batch update")
+
+	// Invalid batch must not be applied partially
+	st.batch(map[string]interface{}{"db/host": "h2", "db/port": "bad"})
+	assert.True(t, len(errors) == 1, "Batch error")
+	assert.True(t, "h1" == cnf.Host && 5432 == cnf.Port, "Batch must not be applied")
+
+	dump, err := heap.Dump(cnf)
+	if assert.NoError(t, err, "Dump") {
+		assert.Equal(t, "h1", dump.Get("db/host").Value)
+	}
+}
+
+func TestBindKeepsFields(t *testing.T) {
+	var (
+		heap registry.BindHeap
+		st   = memory.New(map[string]string{"service/name": "test", "db/host": "h1"})
+		cnf  = &confKept{}
+	)
+	cnf.DB = &struct {
+		Host string `store:"host"`
+	}{}
+	var db = cnf.DB
+	heap.RegisterStore(st)
+	assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+	assert.True(t, db == cnf.DB && "h1" == db.Host, "Preallocated pointer must be used")
+
+	cnf.Lock()
+	cnf.State = "running"
+	cnf.Unlock()
+
+	st.Set("db/host", "h2")
+	st.Set("service/name", "changed")
+
+	assert.True(t, db == cnf.DB && "h2" == db.Host, "Preallocated pointer must be kept")
+	assert.True(t, "changed" == cnf.Name, "Invalid service name")
+	assert.True(t, "running" == cnf.State, "Untagged field must not be reverted")
+}
+
+func TestBindValidator(t *testing.T) {
+	var (
+		heap   registry.BindHeap
+		st     = &store{}
+		cnf    = &confValidated{Port: 80}
+		errors []registry.BindError
+	)
+	heap.RegisterStore(st)
+	heap.OnError(func(err registry.BindError) { errors = append(errors, err) })
+
+	assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+
+	st.fn("service/port", "8080")
+	assert.True(t, 8080 == cnf.Port, "Invalid port")
+
+	st.fn("service/port", "100000")
+	assert.True(t, 8080 == cnf.Port, "Invalid port must be rejected")
+	if assert.True(t, len(errors) == 1, "Validation error") {
+		_, ok := errors[0].Err.(*registry.ValidationError)
+		assert.True(t, ok, "Invalid error type")
+		assert.True(t, cnf == errors[0].Target, "Invalid error target")
+		assert.True(t, st == errors[0].Storage, "Invalid error storage")
+	}
+
+	st.fn("service/port", "9090")
+	assert.True(t, 9090 == cnf.Port, "Invalid port after rejected update")
+}
+
+func TestBindValidatorSource(t *testing.T) {
+	var (
+		heap registry.BindHeap
+		st1  = &store{}
+		st2  = &store{}
+		cnf  = &confValidated{Port: 80}
+	)
+	heap.RegisterStore(st1)
+	heap.RegisterStore(st2)
+	assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+
+	st1.fn("service/port", "8080")
+	st2.fn("service/port", "100000")
+	assert.True(t, 8080 == cnf.Port, "Invalid port must be rejected")
+	assert.True(t, st1 == heap.Source(cnf, "service/port"), "Source of the rejected value")
+
+	st2.fn("service/port", "9090")
+	assert.True(t, 9090 == cnf.Port, "Invalid port")
+	assert.True(t, st2 == heap.Source(cnf, "service/port"), "Invalid port source")
+}
+
+func TestBindError(t *testing.T) {
+	var (
+		heap   registry.BindHeap
+		st     = &store{}
+		cnf    = &confOptions{}
+		errors []registry.BindError
+	)
+	heap.RegisterStore(st)
+	heap.RegisterStore(&tokenStore{})
+	heap.OnError(func(err registry.BindError) { errors = append(errors, err) })
+	assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+
+	st.fn("service/port", "invalid")
+	if assert.True(t, len(errors) == 1, "Conversion error") {
+		assert.True(t, "service/port" == errors[0].Key, "Invalid error key")
+		assert.True(t, "invalid" == errors[0].Value, "Invalid error value")
+		assert.True(t, cnf == errors[0].Target, "Invalid error target")
+		assert.True(t, st == errors[0].Storage, "Invalid error storage")
+		assert.Error(t, errors[0].Err, "Conversion error")
+	}
+	assert.True(t, 8080 == cnf.Port, "Invalid port")
+}
+
+func TestBindNested(t *testing.T) {
+	var (
+		heap registry.BindHeap
+		st   = &store{}
+		cnf  = &confNested{}
+	)
+	heap.RegisterStore(st)
+	assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+
+	st.fn("features/search", "true")
+	st.fn("features/beta/ui", "false")
+	st.fn("hosts/1", "10.0.0.2")
+	st.fn("hosts/0", "10.0.0.1")
+	st.fn("tenants/acme/name", "ACME")
+	st.fn("tenants/acme/limit", "100")
+	st.fn("db/host", "db.local")
+	st.fn("service/listen", ":8080")
+
+	assert.Equal(t, map[string]bool{"search": true, "beta/ui": false}, cnf.Features)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, cnf.Hosts)
+	assert.True(t, "ACME" == cnf.Tenants["acme"].Name && 100 == cnf.Tenants["acme"].Limit, "Invalid tenant")
+	assert.True(t, nil != cnf.DB && "db.local" == cnf.DB.Host, "Invalid db host")
+	assert.True(t, ":8080" == cnf.Service.Listen, "Invalid listen address")
+
+	st.fn("features/search", nil)
+	st.fn("hosts/1", nil)
+	assert.Equal(t, map[string]bool{"beta/ui": false}, cnf.Features)
+	assert.Equal(t, []string{"10.0.0.1"}, cnf.Hosts)
+
+	var errors []registry.BindError
+	heap.OnError(func(err registry.BindError) { errors = append(errors, err) })
+	st.fn("hosts/300000000", "10.0.0.3")
+	if assert.True(t, len(errors) == 1, "Slice index error") {
+		assert.Equal(t, registry.ErrSliceIndexOutOfRange, errors[0].Err)
+	}
+	assert.Equal(t, []string{"10.0.0.1"}, cnf.Hosts)
+}
+
+func TestBindDecode(t *testing.T) {
+	var (
+		heap registry.BindHeap
+		st   = &store{}
+		cnf  = &confDecoded{}
+	)
+	heap.RegisterStore(st)
+	assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+
+	st.fn("service/limits", `{"rps":100,"burst":20}`)
+	st.fn("service/routes", `{"api": "/v1"}`)
+	st.fn("service/started", "2017-10-01T10:00:00Z")
+
+	assert.True(t, 100 == cnf.Limits.RPS && 20 == cnf.Limits.Burst, "Invalid limits")
+	assert.Equal(t, map[string]string{"api": "/v1"}, cnf.Routes)
+	assert.True(t, time.Date(2017, 10, 1, 10, 0, 0, 0, time.UTC).Equal(cnf.Started), "Invalid start time")
+}
+
+func TestBindRequiredDecoded(t *testing.T) {
+	var (
+		heap registry.BindHeap
+		st   = &loadStore{values: map[string]interface{}{}}
+	)
+	heap.RegisterStore(st)
+
+	err := heap.BindAndLoad(context.Background(), &confRequiredDecoded{}, "store", "/")
+	if assert.Error(t, err, "Required key error") {
+		reqErr, _ := err.(*registry.RequiredKeysError)
+		if assert.NotNil(t, reqErr, "Invalid error type") {
+			assert.Equal(t, []string{"service/limits", "service/started"}, reqErr.Keys)
+		}
+	}
+
+	st.values["service/limits"] = `{"rps":100}`
+	st.values["service/started"] = "2017-10-01T10:00:00Z"
+	assert.NoError(t, heap.BindAndLoad(context.Background(), &confRequiredDecoded{}, "store", "/"), "BindAndLoad")
+}
+
+func TestBindPriority(t *testing.T) {
+	var (
+		heap     registry.BindHeap
+		defaults = &store{}
+		consul   = &store{}
+		env      = &store{}
+		cnf      = &conf{}
+	)
+	heap.RegisterStore(defaults, -1)
+	heap.RegisterStore(env, 10)
+	heap.RegisterStore(consul)
+	assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+
+	env.fn("service/ip", "10.0.0.1")
+	consul.fn("service/ip", "10.0.0.2")
+	defaults.fn("service/ip", "10.0.0.3")
+	assert.True(t, "10.0.0.1" == cnf.IP, "Invalid ip address")
+	assert.True(t, env == heap.Source(cnf, "service/ip"), "Invalid ip source")
+
+	env.fn("service/ip", nil)
+	assert.True(t, "10.0.0.2" == cnf.IP, "Invalid ip address after delete")
+	assert.True(t, consul == heap.Source(cnf, "service/ip"), "Invalid ip source after delete")
+
+	consul.fn("service/ip", nil)
+	assert.True(t, "10.0.0.3" == cnf.IP, "Invalid default ip address")
+	assert.True(t, defaults == heap.Source(cnf, "service/ip"), "Invalid default ip source")
+}
+
+func TestBindSecret(t *testing.T) {
+	var (
+		heap   registry.BindHeap
+		st     = &store{}
+		cnf    = &confSecret{}
+		key    = []byte("0123456789abcdef")
+		errors []registry.BindError
+	)
+	decrypter, err := registry.NewAESDecrypter(key)
+	if !assert.NoError(t, err, "Decrypter") {
+		return
+	}
+
+	heap.SetDecrypter(decrypter)
+	heap.RegisterStore(st)
+	heap.OnError(func(err registry.BindError) { errors = append(errors, err) })
+	assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+
+	st.fn("db/user", "admin")
+	st.fn("db/password", encrypt(t, key, "p@ssw0rd"))
+	assert.True(t, "admin" == cnf.User, "Invalid user")
+	assert.True(t, "p@ssw0rd" == cnf.Password, "Invalid password")
+
+	st.fn("db/password", "not encrypted")
+	st.fn("db/port", encrypt(t, key, "port"))
+	if assert.True(t, len(errors) == 2, "Secret errors") {
+		for _, err := range errors {
+			assert.True(t, registry.RedactedValue == err.Value, "Secret value is not redacted")
+			assert.NotContains(t, err.Error(), "not encrypted")
+			assert.NotContains(t, err.Error(), `"port"`)
+		}
+	}
+	assert.True(t, "p@ssw0rd" == cnf.Password, "Invalid password after error")
+}
+
+func TestBindSecretPriority(t *testing.T) {
+	var (
+		heap registry.BindHeap
+		low  = &store{}
+		high = &store{}
+		cnf  = &confSecret{}
+	)
+	heap.RegisterStore(low)
+	heap.RegisterStore(high, 10)
+	assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+
+	low.fn("db/password", "low")
+	low.fn("db/port", 5432)
+	high.fn("db/password", "high")
+	high.fn("db/port", 6543)
+	assert.True(t, "high" == cnf.Password && 6543 == cnf.Port, "Invalid high priority values")
+
+	low.fn("db/password", "low2")
+	assert.True(t, "high" == cnf.Password, "Invalid password after low priority update")
+
+	high.fn("db/password", nil)
+	high.fn("db/port", nil)
+	assert.True(t, "low2" == cnf.Password && 5432 == cnf.Port, "Invalid values after fallback to low priority")
+}
+
+func encrypt(t *testing.T, key []byte, value string) string {
+	block, err := aes.NewCipher(key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); nil != err {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(value), nil))
+}
+
+func TestBindDump(t *testing.T) {
+	var (
+		heap     registry.BindHeap
+		nestHeap registry.BindHeap
+		st       = &store{}
+		nestSt   = &namedStore{}
+		cnf      = &confSecret{}
+		nest     = &confNested{}
+	)
+	heap.RegisterStore(st)
+	assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+	nestHeap.RegisterStore(nestSt)
+	assert.NoError(t, nestHeap.Bind(nest, "store", "/"), "Bind nested")
+
+	st.fn("db/user", "admin")
+	st.fn("db/password", "p@ssw0rd")
+	nestSt.fn("features/search", "true")
+	nestSt.fn("hosts/0", "10.0.0.1")
+
+	dump, err := heap.Dump(cnf)
+	if assert.NoError(t, err, "Dump") {
+		assert.Equal(t, registry.ConfigDump{
+			{Key: "db/password", Value: registry.RedactedValue, State: registry.KeyBound, Source: "*registry_test.store#0", Secret: true},
+			{Key: "db/port", Value: registry.RedactedValue, State: registry.KeyUnbound, Secret: true},
+			{Key: "db/user", Value: "admin", State: registry.KeyBound, Source: "*registry_test.store#0"},
+		}, dump)
+
+		data, err := dump.JSON()
+		assert.NoError(t, err, "JSON export")
+		assert.NotContains(t, string(data), "p@ssw0rd")
+	}
+
+	dump, err = nestHeap.Dump(nest)
+	if assert.NoError(t, err, "Dump nested") {
+		assert.Equal(t, true, dump.Get("features/search").Value)
+		assert.Equal(t, "10.0.0.1", dump.Get("hosts/0").Value)
+		assert.Equal(t, "named", dump.Get("hosts/0").Source)
+		assert.Equal(t, registry.KeyUnbound, dump.Get("service/listen").State)
+	}
+
+	var diff = registry.Diff(registry.ConfigDump{
+		{Key: "hosts/0", Value: "10.0.0.2", State: registry.KeyBound},
+		{Key: "features/search", Value: "true", State: registry.KeyBound},
+		{Key: "db/host", Value: "db.local", State: registry.KeyBound},
+	}, dump)
+	if assert.True(t, len(diff) > 2, "Diff") {
+		assert.True(t, "db/host" == diff[0].Key && nil == diff[0].New, "Invalid missing key")
+		assert.True(t, "hosts/0" == diff[1].Key && "10.0.0.1" == diff[1].New.Value, "Invalid changed key")
+	}
+
+	var (
+		expected = registry.ConfigDump{{Key: "features/search", Value: "true", State: registry.KeyDefault}}
+		current  = registry.ConfigDump{*dump.Get("features/search")}
+	)
+	assert.Len(t, registry.Diff(expected, current), 0, "Values are equal")
+	assert.Len(t, registry.DiffStates(expected, current), 1, "States are different")
+
+	_, err = heap.Dump(&conf{})
+	assert.Equal(t, registry.ErrUnbindedConfig, err)
+}
+
+func TestBindUnbind(t *testing.T) {
+	var (
+		heap registry.BindHeap
+		st   = memory.New(map[string]string{"service/name": "test"})
+		wg   sync.WaitGroup
+	)
+	heap.RegisterStore(st)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var cnf = &conf{}
+			assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+			assert.Equal(t, registry.ErrAlreadyBindedConfig, heap.Bind(cnf, "store", "/"))
+			st.Set("service/ip", "127.0.0.1")
+			assert.NoError(t, heap.Unbind(cnf), "Unbind")
+		}()
+	}
+	wg.Wait()
+
+	var cnf = &conf{}
+	assert.NoError(t, heap.Bind(cnf, "store", "/"), "Bind")
+	assert.True(t, "test" == cnf.Service, "Invalid service name")
+
+	assert.NoError(t, heap.Unbind(cnf), "Unbind")
+	assert.Equal(t, registry.ErrUnbindedConfig, heap.Unbind(cnf))
+
+	st.Set("service/name", "changed")
+	assert.True(t, "test" == cnf.Service, "Config is changed after unbind")
+}
@@ -8,39 +8,88 @@ package registry
 import (
 	"io"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/demdxx/gocast"
 )
 
+// MaxSliceIndex is the maximal index of slice item keys like `hosts/3`,
+// keys with bigger index are rejected with ErrSliceIndexOutOfRange
+// to prevent huge allocations by keys from remote storages
+const MaxSliceIndex = 1023
+
 type bindKeyUpdater interface {
 	ConfigKeyUpdate(target interface{}, key string, value interface{}) error
 }
 
+// bindKeyDeleter can be implemented by the key updater
+// to receive deletion of the key separately from the updates,
+// otherwise ConfigKeyUpdate is called with nil value
+type bindKeyDeleter interface {
+	ConfigKeyDelete(target interface{}, key string) error
+}
+
 type bindUpdater interface {
 	UpdateKey(key string, value interface{}) error
 	Subscribe(key string, b bindKeyUpdater)
 	Unsubscribe(key string, b bindKeyUpdater)
 }
 
+// bindKeyValidator can be implemented by the key updater
+// to validate the candidate config before changes of the key are applied
+type bindKeyValidator interface {
+	ConfigValidate(candidate interface{}) error
+}
+
+// bindBatchUpdater can be implemented by the updater
+// to apply all changes of one storage refresh as a unit
+type bindBatchUpdater interface {
+	UpdateKeys(values map[string]interface{}) error
+}
+
+// bindSecretChecker can be implemented by the updater
+// to keep values of secret keys sealed in layers of the bind
+type bindSecretChecker interface {
+	isSecret(key string) bool
+}
+
 type bindWrapper struct {
 	sync.Mutex
+
+	// updateMx serializes updates of the config, key subscribers
+	// and validators are called under it without the main lock
+	updateMx sync.Mutex
+
 	previousData map[string]*string
 	subscribe    map[string][]bindKeyUpdater
 	tagSeparator rune
 	tagName      string
 	target       interface{}
+	current      atomic.Value
+	atomicMode   bool
+	secrets      []string
+	salt         []byte
+	decrypter    Decrypter
+
+	changeHandlers []func(conf interface{}, keys []string)
 }
 
 // WrapConf bind field updater
 func WrapConf(conf interface{}, tagName string, pathSeparator rune) bindUpdater {
-	return &bindWrapper{
+	var wr = &bindWrapper{
 		previousData: map[string]*string{},
 		tagSeparator: pathSeparator,
 		tagName:      tagName,
 		target:       conf,
+		salt:         randomBytes(32),
 	}
+	wr.secrets = wr.secretKeys(reflect.TypeOf(conf), "", map[reflect.Type]bool{})
+	wr.commit(conf)
+	return wr
 }
 
 // UpdateKey in config
@@ -48,62 +97,75 @@ func (wr *bindWrapper) UpdateKey(key string, value interface{}) error {
 	if "" == key {
 		return ErrInvalidKeyParam
 	}
+	return wr.UpdateKeys(map[string]interface{}{key: value})
+}
 
-	if nil != wr.subscribe {
-		var end = false
-
-		for baseKey, subs := range wr.subscribe {
-			if key == baseKey || strings.HasPrefix(key, baseKey) {
-				for _, sub := range subs {
-					if err := sub.ConfigKeyUpdate(wr.target, key, value); nil != err {
-						if io.EOF == err {
-							end = true
-						} else {
-							return err
-						}
-					}
-				} // end for
-			}
+// UpdateKeys applies the batch of changes as a unit.
+// In atomic mode the new version of the config becomes available
+// only after all changes are applied successfully.
+func (wr *bindWrapper) UpdateKeys(values map[string]interface{}) error {
+	var keys = make([]string, 0, len(values))
+	for key := range values {
+		if "" == key {
+			return ErrInvalidKeyParam
 		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-		if end {
-			return nil
-		}
+	wr.updateMx.Lock()
+	var target, changed, err = wr.applyKeys(keys, values)
+	wr.updateMx.Unlock()
+
+	if nil != err || len(changed) < 1 {
+		return err
 	}
 
-	if !wr.upAndContinue(key, value) {
-		return nil
+	wr.Lock()
+	var handlers = wr.changeHandlers
+	wr.Unlock()
+
+	for _, h := range handlers {
+		h(target, changed)
 	}
+	return nil
+}
+
+// OnChange registers the handler which is called once
+// after each applied update with the list of changed keys
+func (wr *bindWrapper) OnChange(h func(conf interface{}, keys []string)) {
+	wr.Lock()
+	wr.changeHandlers = append(wr.changeHandlers, h)
+	wr.Unlock()
+}
 
-	return wr.setStructItem(
-		reflect.ValueOf(wr.target),
-		value,
-		key,
-		strings.Split(key, string(wr.tagSeparator))...)
+// Snapshot returns the last consistent copy of the config
+func (wr *bindWrapper) Snapshot() interface{} {
+	return wr.current.Load()
 }
 
 // Subscribe key updater
 func (wr *bindWrapper) Subscribe(key string, b bindKeyUpdater) {
+	wr.Lock()
+	defer wr.Unlock()
+
 	if nil == wr.subscribe {
 		wr.subscribe = map[string][]bindKeyUpdater{}
 	}
 
-	wr.Lock()
-	defer wr.Unlock()
-
 	subs, _ := wr.subscribe[key]
 	wr.subscribe[key] = append(subs, b)
 }
 
 // Unsubscribe key updater
 func (wr *bindWrapper) Unsubscribe(key string, b bindKeyUpdater) {
+	wr.Lock()
+	defer wr.Unlock()
+
 	if nil == wr.subscribe {
 		return
 	}
 
-	wr.Lock()
-	defer wr.Unlock()
-
 	if subs, _ := wr.subscribe[key]; len(subs) > 0 {
 		var newSubs []bindKeyUpdater
 
@@ -127,104 +189,740 @@ func (wr *bindWrapper) fieldTagName(field reflect.StructField) string {
 	return field.Tag.Get(wr.tagName)
 }
 
-func (wr *bindWrapper) setStructItem(ref reflect.Value, value interface{}, key string, keys ...string) (err error) {
-	if ref = unpoint(ref); !ref.IsValid() || (ref.Kind() == reflect.Ptr && ref.IsNil()) {
-		return ErrInvalidTargetStruct
+// applyDefaults sets default values declared in the field tags
+func (wr *bindWrapper) applyDefaults() error {
+	return wr.eachField(reflect.ValueOf(wr.target), "", func(key string, opts tagOptions, field reflect.Value) error {
+		if !opts.hasDefault() {
+			return nil
+		}
+		return wr.setValue(field, *opts.defaultValue, opts.format)
+	})
+}
+
+// missingKeys returns the list of required keys without any value
+func (wr *bindWrapper) missingKeys() (keys []string) {
+	wr.Lock()
+	defer wr.Unlock()
+
+	wr.eachField(reflect.ValueOf(wr.target), "", func(key string, opts tagOptions, field reflect.Value) error {
+		var subtree = isContainer(field.Type()) && !isDecodable(indirectType(field.Type()), opts.format)
+		if opts.required && !opts.hasDefault() && !wr.hasValue(key, subtree) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return
+}
+
+// hasValue returns true if the key or any key of the subtree has value,
+// must be called under the lock
+func (wr *bindWrapper) hasValue(key string, subtree bool) bool {
+	if v, _ := wr.previousData[key]; nil != v {
+		return true
+	}
+	if subtree {
+		var prefix = key + string(wr.tagSeparator)
+		for k, v := range wr.previousData {
+			if nil != v && strings.HasPrefix(k, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// eachField walks over all tagged fields of the struct with the full key path,
+// decodable structs like time.Time or fields with format are single keys
+func (wr *bindWrapper) eachField(ref reflect.Value, prefix string, fn func(key string, opts tagOptions, field reflect.Value) error) error {
+	if ref = unpoint(ref); !ref.IsValid() || ref.Kind() != reflect.Struct {
+		return nil
 	}
 
 	var tp = ref.Type()
 	for i := 0; i < tp.NumField(); i++ {
 		var (
+			err   error
 			field = tp.Field(i)
 			tag   = wr.fieldTagName(field)
 		)
 
+		if field.PkgPath != "" {
+			continue // Skip unexported fields
+		}
+
 		if tag == "" {
-			err = wr.setStructItem(ref.Field(i), value, key, keys...)
+			err = wr.eachField(ref.Field(i), prefix, fn)
 		} else {
-			if newKey, set := wr.prepareKey(key, tag, keys); set {
-				err = wr.setValue(ref.Field(i), value)
-			} else if len(newKey) > 0 {
-				err = wr.setStructItem(ref.Field(i), value, key, newKey...)
+			var (
+				opts = parseTag(tag)
+				key  = wr.joinKey(prefix, opts.path)
+			)
+			var tp = indirectType(field.Type)
+			if tp.Kind() == reflect.Struct && !opts.hasDefault() && !isDecodable(tp, opts.format) {
+				err = wr.eachField(ref.Field(i), key, fn)
+			} else {
+				err = fn(key, opts, ref.Field(i))
 			}
 		}
 
 		if nil != err {
-			break
+			return err
 		}
 	}
-	return
+	return nil
+}
+
+func (wr *bindWrapper) joinKey(prefix, path string) string {
+	switch {
+	case len(path) > 0 && wr.tagSeparator == rune(path[0]):
+		return path[1:]
+	case prefix == "":
+		return path
+	}
+	return prefix + string(wr.tagSeparator) + path
 }
 
-func (wr *bindWrapper) prepareKey(baseKey, curKey string, keys []string) ([]string, bool) {
-	if wr.tagSeparator == rune(curKey[0]) {
-		curKey = curKey[1:]
+// applyKeys to the copy of the config and commit the new version if all keys
+// are applied. It's called under the update lock, subscribers and validators
+// are called without the main lock so they can use the heap.
+func (wr *bindWrapper) applyKeys(keys []string, values map[string]interface{}) (target interface{}, changed []string, err error) {
+	// All changes are applied to the copy of the config, in atomic mode the copy
+	// becomes the new version, otherwise the changed keys are applied to the bound
+	// config only after all keys are applied and validated successfully
+	wr.Lock()
+	var (
+		subscribe = wr.subscribers()
+		decrypter = wr.decrypter
+		stored    = make(map[string]*string, len(keys))
+		applied   = make(map[string]interface{}, len(keys))
+		handled   bool
+		base      interface{}
+	)
+	if wr.atomicMode {
+		target = copyValue(reflect.ValueOf(wr.current.Load())).Interface()
 	} else {
-		baseKey = strings.Join(keys, string(wr.tagSeparator))
+		target = copyValue(reflect.ValueOf(wr.target)).Interface()
+		if len(subscribe) > 0 {
+			// Changes of key subscribers are detected by the comparison with the base
+			base = copyValue(reflect.ValueOf(wr.target)).Interface()
+		}
+	}
+	wr.Unlock()
+
+	for _, key := range keys {
+		var (
+			ok, byHandler bool
+			value         = values[key]
+			secret        = wr.isSecret(key)
+		)
+		if secret {
+			value, err = decryptValue(decrypter, value)
+		}
+		if nil == err {
+			ok, byHandler, err = wr.applyKey(subscribe, stored, target, key, value, secret)
+		}
+		if nil != err {
+			return nil, nil, BindError{Key: key, Value: wr.redact(key, values[key]), Target: wr.target, Err: err}
+		}
+		if ok {
+			changed = append(changed, key)
+			if byHandler {
+				handled = true
+			} else {
+				applied[key] = value
+			}
+		}
+	}
+
+	if len(changed) < 1 {
+		return target, nil, nil
+	}
+
+	if wr.isValidated(subscribe) {
+		if err = wr.validate(subscribe, target, changed); nil != err {
+			return nil, nil, BindError{Target: wr.target, Err: err}
+		}
+	}
+
+	wr.Lock()
+	defer wr.Unlock()
+
+	for key, value := range stored {
+		wr.previousData[key] = value
 	}
 
-	if strings.HasPrefix(baseKey, curKey) {
-		if curKey = baseKey[len(curKey)-1:]; len(curKey) > 1 {
-			if wr.tagSeparator == rune(curKey[0]) {
-				return strings.Split(curKey, string(wr.tagSeparator)), false
+	if !wr.atomicMode {
+		// Only changed keys are applied, so other fields, pointers
+		// and containers of the bound config are kept as is
+		var ref = reflect.ValueOf(wr.target)
+		for _, key := range changed {
+			if value, ok := applied[key]; ok {
+				if err = wr.setStructItem(ref, value, key, key); nil != err {
+					return nil, nil, BindError{Key: key, Value: wr.redact(key, value), Target: wr.target, Err: err}
+				}
+			}
+		}
+		if handled {
+			mergeChanges(ref, reflect.ValueOf(base), reflect.ValueOf(target))
+		}
+		target = wr.target
+	}
+
+	wr.commit(target)
+	return target, changed, nil
+}
+
+// subscribers returns the copy of key subscribers, must be called under the lock
+func (wr *bindWrapper) subscribers() map[string][]bindKeyUpdater {
+	var subscribe = make(map[string][]bindKeyUpdater, len(wr.subscribe))
+	for key, subs := range wr.subscribe {
+		subscribe[key] = subs
+	}
+	return subscribe
+}
+
+// isValidated returns true if the config or key subscribers have validators
+func (wr *bindWrapper) isValidated(subscribe map[string][]bindKeyUpdater) bool {
+	if _, ok := wr.target.(Validator); ok {
+		return true
+	}
+	for _, subs := range subscribe {
+		for _, sub := range subs {
+			if _, ok := sub.(bindKeyValidator); ok {
+				return true
 			}
-		} else {
-			return nil, true
 		}
 	}
-	return nil, false
+	return false
 }
 
-func (wr *bindWrapper) setValue(ref reflect.Value, value interface{}) (err error) {
-	if nil == value {
-		ref.Set(reflect.Zero(ref.Type()))
-	} else {
-		var val interface{}
-		if val, err = gocast.ToT(value, ref.Type(), ""); nil == err {
-			ref.Set(reflect.ValueOf(val))
+// validate candidate config before the commit
+func (wr *bindWrapper) validate(subscribe map[string][]bindKeyUpdater, candidate interface{}, keys []string) error {
+	if v, ok := candidate.(Validator); ok {
+		if err := v.Validate(); nil != err {
+			return &ValidationError{Keys: keys, Err: err}
+		}
+	}
+
+	for baseKey, subs := range subscribe {
+		if !hasKeyWithPrefix(keys, baseKey) {
+			continue
+		}
+		for _, sub := range subs {
+			if v, ok := sub.(bindKeyValidator); ok {
+				if err := v.ConfigValidate(candidate); nil != err {
+					return &ValidationError{Keys: keys, Err: err}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// applyKey change to the target, returns false if the key wasn't changed
+// and true as the second value if the key was handled by the key subscriber.
+// The new value of the key is put into the stored map.
+// Errors of conversion of secret values are hidden because they can contain the value.
+func (wr *bindWrapper) applyKey(subscribe map[string][]bindKeyUpdater, stored map[string]*string, target interface{}, key string, value interface{}, secret bool) (bool, bool, error) {
+	if len(subscribe) > 0 {
+		var end = false
+
+		for baseKey, subs := range subscribe {
+			if key == baseKey || strings.HasPrefix(key, baseKey) {
+				for _, sub := range subs {
+					if err := wr.notifySubscriber(sub, target, key, value); nil != err {
+						if io.EOF == err {
+							end = true
+						} else {
+							return false, false, err
+						}
+					}
+				} // end for
+			}
+		}
+
+		if end {
+			return true, true, nil
+		}
+	}
+
+	var stValue, ok = wr.upAndContinue(key, value, secret)
+	if !ok {
+		return false, false, nil
+	}
+
+	if err := wr.setStructItem(reflect.ValueOf(target), value, key, key); nil != err {
+		if secret {
+			err = ErrInvalidSecretValue
+		}
+		return false, false, err
+	}
+
+	stored[key] = stValue
+	return true, false, nil
+}
+
+// setDecrypter of secret values
+func (wr *bindWrapper) setDecrypter(d Decrypter) {
+	wr.Lock()
+	wr.decrypter = d
+	wr.Unlock()
+}
+
+// isSecret returns true if the key or its parent key is marked as secret
+func (wr *bindWrapper) isSecret(key string) bool {
+	for _, secret := range wr.secrets {
+		if key == secret || strings.HasPrefix(key, secret+string(wr.tagSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact value of the secret key
+func (wr *bindWrapper) redact(key string, value interface{}) interface{} {
+	if nil != value && wr.isSecret(key) {
+		return RedactedValue
+	}
+	return value
+}
+
+// secretKeys returns keys of all fields with the tag option `secret`,
+// all subkeys of these keys are secret too
+func (wr *bindWrapper) secretKeys(tp reflect.Type, prefix string, visited map[reflect.Type]bool) (keys []string) {
+	if nil == tp {
+		return nil
+	}
+	if tp = indirectType(tp); tp.Kind() != reflect.Struct || visited[tp] {
+		return nil
+	}
+
+	visited[tp] = true
+	defer delete(visited, tp)
+
+	for i := 0; i < tp.NumField(); i++ {
+		var (
+			field = tp.Field(i)
+			tag   = wr.fieldTagName(field)
+		)
+
+		if field.PkgPath != "" {
+			continue // Skip unexported fields
+		}
+
+		if tag == "" {
+			keys = append(keys, wr.secretKeys(field.Type, prefix, visited)...)
+			continue
+		}
+
+		var (
+			opts = parseTag(tag)
+			key  = wr.joinKey(prefix, opts.path)
+		)
+
+		if opts.secret {
+			keys = append(keys, key)
+		} else {
+			keys = append(keys, wr.secretKeys(field.Type, key, visited)...)
 		}
 	}
 	return
 }
 
-func (wr *bindWrapper) upAndContinue(key string, value interface{}) bool {
-	if v, ok := wr.previousData[key]; ok {
-		if nil == value && v == nil {
-			return false // Same value
+// setAtomic switches the wrapper into the mode when the target
+// is not changed anymore and all updates are applied to copies
+func (wr *bindWrapper) setAtomic() {
+	wr.Lock()
+	wr.atomicMode = true
+	wr.Unlock()
+}
+
+// commit new version of the config
+func (wr *bindWrapper) commit(target interface{}) {
+	if wr.atomicMode {
+		wr.current.Store(target)
+	} else {
+		wr.current.Store(copyValue(reflect.ValueOf(target)).Interface())
+	}
+}
+
+func (wr *bindWrapper) notifySubscriber(sub bindKeyUpdater, target interface{}, key string, value interface{}) error {
+	if deleter, ok := sub.(bindKeyDeleter); ok && nil == value {
+		return deleter.ConfigKeyDelete(target, key)
+	}
+	return sub.ConfigKeyUpdate(target, key, value)
+}
+
+// setStructItem sets the value into the field matched to the key,
+// the path is the part of the key relative to the current struct
+func (wr *bindWrapper) setStructItem(ref reflect.Value, value interface{}, key, path string) (err error) {
+	if ref = unpoint(ref); !ref.IsValid() || ref.Kind() != reflect.Struct {
+		return ErrInvalidTargetStruct
+	}
+
+	var tp = ref.Type()
+	for i := 0; i < tp.NumField(); i++ {
+		var (
+			field = tp.Field(i)
+			tag   = wr.fieldTagName(field)
+		)
+
+		if field.PkgPath != "" {
+			continue // Skip unexported fields
 		}
 
-		switch v2 := value.(type) {
-		case string:
-			if *v == v2 {
-				return false
+		if tag == "" {
+			var fieldRef = ref.Field(i)
+			if fieldRef.Kind() == reflect.Ptr && fieldRef.IsNil() {
+				continue // Untagged pointers are not allocated
 			}
-		case []byte:
-			if *v == string(v2) {
-				return false
+			if indirectType(field.Type).Kind() == reflect.Struct {
+				err = wr.setNested(fieldRef, value, key, path, "")
+			}
+		} else {
+			var opts = parseTag(tag)
+			if subPath, set, ok := wr.prepareKey(key, path, opts.path); set {
+				if nil == value && opts.hasDefault() {
+					err = wr.setValue(ref.Field(i), *opts.defaultValue, opts.format)
+				} else {
+					err = wr.setValue(ref.Field(i), value, opts.format)
+				}
+			} else if ok {
+				err = wr.setNested(ref.Field(i), value, key, subPath, opts.format)
+			}
+		}
+
+		if nil != err {
+			break
+		}
+	}
+	return
+}
+
+// setNested value into the struct, map or slice by the relative path
+func (wr *bindWrapper) setNested(ref reflect.Value, value interface{}, key, path, format string) error {
+	switch ref.Kind() {
+	case reflect.Ptr:
+		if ref.IsNil() {
+			if nil == value {
+				return nil // Nothing to delete
 			}
+			ref.Set(reflect.New(ref.Type().Elem()))
+		}
+		return wr.setNested(ref.Elem(), value, key, path, format)
+	case reflect.Struct:
+		return wr.setStructItem(ref, value, key, path)
+	case reflect.Map:
+		return wr.setMapItem(ref, value, key, path, format)
+	case reflect.Slice, reflect.Array:
+		return wr.setSliceItem(ref, value, key, path, format)
+	}
+	return nil
+}
+
+// setMapItem by the relative path. Maps of scalar values use the
+// whole path as the map key, maps of complex values use the first
+// element of the path.
+func (wr *bindWrapper) setMapItem(ref reflect.Value, value interface{}, key, path, format string) (err error) {
+	var (
+		tp      = ref.Type()
+		subPath string
+		mapKey  reflect.Value
+	)
+
+	if tp.Key().Kind() != reflect.String {
+		return nil
+	}
+
+	if isContainer(tp.Elem()) {
+		if idx := strings.IndexRune(path, wr.tagSeparator); idx >= 0 {
+			path, subPath = path[:idx], path[idx+1:]
+		}
+	}
+
+	mapKey = reflect.ValueOf(path).Convert(tp.Key())
+
+	if nil == value && subPath == "" {
+		if !ref.IsNil() {
+			ref.SetMapIndex(mapKey, reflect.Value{})
+		}
+		return nil
+	}
+
+	var item = reflect.New(tp.Elem()).Elem()
+	if !ref.IsNil() {
+		if v := ref.MapIndex(mapKey); v.IsValid() {
+			item.Set(v)
+		}
+	} else if nil == value {
+		return nil // Nothing to delete
+	}
+
+	if subPath == "" {
+		err = wr.setValue(item, value, format)
+	} else {
+		err = wr.setNested(item, value, key, subPath, format)
+	}
+
+	if nil == err {
+		if ref.IsNil() {
+			ref.Set(reflect.MakeMap(tp))
+		}
+		ref.SetMapIndex(mapKey, item)
+	}
+	return err
+}
+
+// setSliceItem by the index from the first element of the relative path
+func (wr *bindWrapper) setSliceItem(ref reflect.Value, value interface{}, key, path, format string) error {
+	var subPath string
+	if idx := strings.IndexRune(path, wr.tagSeparator); idx >= 0 {
+		path, subPath = path[:idx], path[idx+1:]
+	}
+
+	index, err := strconv.Atoi(path)
+	if nil != err || index < 0 {
+		return nil // Not an index key
+	}
+
+	if index >= ref.Len() {
+		if nil == value || ref.Kind() == reflect.Array {
+			return nil
+		}
+		if index > MaxSliceIndex {
+			return ErrSliceIndexOutOfRange
+		}
+		var items = reflect.MakeSlice(ref.Type(), index+1, index+1)
+		reflect.Copy(items, ref)
+		ref.Set(items)
+	}
+
+	if subPath != "" {
+		return wr.setNested(ref.Index(index), value, key, subPath, format)
+	}
+
+	if nil == value && ref.Kind() == reflect.Slice && index == ref.Len()-1 {
+		ref.Set(ref.Slice(0, index))
+		return nil
+	}
+	return wr.setValue(ref.Index(index), value, format)
+}
+
+// prepareKey returns sub path of the key if the tag path is a prefix of the key,
+// or set flag if the tag path matches the whole key.
+// Tag path which starts from the separator is absolute.
+func (wr *bindWrapper) prepareKey(key, path, tagPath string) (subPath string, set, ok bool) {
+	if len(tagPath) > 0 && wr.tagSeparator == rune(tagPath[0]) {
+		tagPath, path = tagPath[1:], key
+	}
+
+	if path == tagPath {
+		return "", true, true
+	}
+
+	if strings.HasPrefix(path, tagPath) && len(path) > len(tagPath) {
+		if wr.tagSeparator == rune(path[len(tagPath)]) {
+			return path[len(tagPath)+1:], false, true
 		}
 	}
+	return "", false, false
+}
 
+// setValue converts the value to the field type. Values of fields with
+// format option and of types which implement encoding.TextUnmarshaler
+// or json.Unmarshaler are decoded from the raw value
+func (wr *bindWrapper) setValue(ref reflect.Value, value interface{}, format string) (err error) {
 	if nil == value {
-		wr.previousData[key] = nil
+		ref.Set(reflect.Zero(ref.Type()))
+	} else if data, ok := rawValue(value); ok && isDecodable(ref.Type(), format) {
+		var val = reflect.New(ref.Type())
+		if err = decodeValue(val.Interface(), data, format); nil == err {
+			ref.Set(val.Elem())
+		}
 	} else {
-		var vv = new(string)
+		var val interface{}
+		if val, err = gocast.ToT(value, ref.Type(), ""); nil == err {
+			ref.Set(reflect.ValueOf(val))
+		}
+	}
+	return
+}
+
+// upAndContinue returns the new value of the key to store and false if the
+// value wasn't changed. Salted digests are kept instead of values of secret keys.
+// It's called under the update lock.
+func (wr *bindWrapper) upAndContinue(key string, value interface{}, secret bool) (*string, bool) {
+	var vv *string
+	if nil != value {
+		vv = new(string)
 		switch v := value.(type) {
 		case string:
 			*vv = v
-			wr.previousData[key] = vv
 		case []byte:
 			*vv = string(v)
-			wr.previousData[key] = vv
+		default:
+			*vv = gocast.ToString(v)
+		}
+		if secret {
+			*vv = secretDigest(wr.salt, *vv)
+		}
+	}
+
+	if v, ok := wr.previousData[key]; ok {
+		if nil == vv && nil == v {
+			return nil, false // Same value
+		}
+
+		if nil != v && nil != vv && *v == *vv {
+			switch value.(type) {
+			case string, []byte:
+				return nil, false
+			}
 		}
 	}
-	return true
+	return vv, true
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 /// Helpers
 ///////////////////////////////////////////////////////////////////////////////
 
+// copyValue makes the deep copy of the value
+func copyValue(src reflect.Value) reflect.Value {
+	switch src.Kind() {
+	case reflect.Ptr:
+		if src.IsNil() {
+			return src
+		}
+		var dst = reflect.New(src.Type().Elem())
+		dst.Elem().Set(copyValue(src.Elem()))
+		return dst
+	case reflect.Interface:
+		if src.IsNil() {
+			return src
+		}
+		var dst = reflect.New(src.Type()).Elem()
+		dst.Set(copyValue(src.Elem()))
+		return dst
+	case reflect.Struct:
+		var dst = reflect.New(src.Type()).Elem()
+		dst.Set(src)
+		for i := 0; i < src.NumField(); i++ {
+			if dst.Field(i).CanSet() {
+				dst.Field(i).Set(copyValue(src.Field(i)))
+			}
+		}
+		return dst
+	case reflect.Array:
+		var dst = reflect.New(src.Type()).Elem()
+		for i := 0; i < src.Len(); i++ {
+			dst.Index(i).Set(copyValue(src.Index(i)))
+		}
+		return dst
+	case reflect.Slice:
+		if src.IsNil() {
+			return src
+		}
+		var dst = reflect.MakeSlice(src.Type(), src.Len(), src.Len())
+		for i := 0; i < src.Len(); i++ {
+			dst.Index(i).Set(copyValue(src.Index(i)))
+		}
+		return dst
+	case reflect.Map:
+		if src.IsNil() {
+			return src
+		}
+		var dst = reflect.MakeMap(src.Type())
+		for _, key := range src.MapKeys() {
+			dst.SetMapIndex(key, copyValue(src.MapIndex(key)))
+		}
+		return dst
+	}
+	return src
+}
+
+// mergeChanges sets values of src which differ from base into dst.
+// Structs are merged by fields, so fields which are not changed
+// keep their values and pointers of dst.
+func mergeChanges(dst, base, src reflect.Value) {
+	switch src.Kind() {
+	case reflect.Ptr:
+		if !src.IsNil() && !base.IsNil() && !dst.IsNil() && hasSettableFields(src.Elem()) {
+			mergeChanges(dst.Elem(), base.Elem(), src.Elem())
+			return
+		}
+	case reflect.Struct:
+		if hasSettableFields(src) {
+			for i := 0; i < src.NumField(); i++ {
+				if dst.Field(i).CanSet() {
+					mergeChanges(dst.Field(i), base.Field(i), src.Field(i))
+				}
+			}
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(base.Interface(), src.Interface()) {
+		dst.Set(src)
+	}
+}
+
+// hasSettableFields returns true if the value is the struct with exported fields
+func hasSettableFields(ref reflect.Value) bool {
+	if ref.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < ref.NumField(); i++ {
+		if ref.Field(i).CanSet() {
+			return true
+		}
+	}
+	return false
+}
+
+// decryptValue of the secret key, without decrypter the value is used as is
+func decryptValue(d Decrypter, value interface{}) (interface{}, error) {
+	if nil == value || nil == d {
+		return value, nil
+	}
+
+	data, ok := rawValue(value)
+	if !ok {
+		data = []byte(gocast.ToString(value))
+	}
+
+	plain, err := d.Decrypt(data)
+	if nil != err {
+		return nil, err
+	}
+	return string(plain), nil
+}
+
+func hasKeyWithPrefix(keys []string, prefix string) bool {
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func indirectType(tp reflect.Type) reflect.Type {
+	for tp.Kind() == reflect.Ptr {
+		tp = tp.Elem()
+	}
+	return tp
+}
+
+// isContainer returns true for types which are filled by the key subtree
+func isContainer(tp reflect.Type) bool {
+	switch indirectType(tp).Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		return true
+	}
+	return false
+}
+
 func unpoint(ref reflect.Value) reflect.Value {
 	for ref.IsValid() && ref.Kind() == reflect.Ptr && !ref.IsNil() {
 		ref = ref.Elem()
@@ -0,0 +1,208 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/demdxx/gocast"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Key states of the config dump
+const (
+	KeyBound   = "bound"
+	KeyDefault = "default"
+	KeyUnbound = "unbound"
+)
+
+// DumpItem is the value of one config key in the ConfigDump
+type DumpItem struct {
+	Key    string      `json:"key" yaml:"key"`
+	Value  interface{} `json:"value" yaml:"value"`
+	State  string      `json:"state" yaml:"state"`
+	Source string      `json:"source,omitempty" yaml:"source,omitempty"`
+	Secret bool        `json:"secret,omitempty" yaml:"secret,omitempty"`
+}
+
+// ConfigDump is the flattened view of the config sorted by keys.
+// Values of secret keys are redacted.
+type ConfigDump []DumpItem
+
+// Get item by key, the dump must be sorted
+func (d ConfigDump) Get(key string) *DumpItem {
+	var idx = sort.Search(len(d), func(i int) bool { return d[i].Key >= key })
+	if idx < len(d) && d[idx].Key == key {
+		return &d[idx]
+	}
+	return nil
+}
+
+// Values of keys
+func (d ConfigDump) Values() map[string]interface{} {
+	var values = make(map[string]interface{}, len(d))
+	for _, item := range d {
+		values[item.Key] = item.Value
+	}
+	return values
+}
+
+// items of the dump by keys
+func (d ConfigDump) items() map[string]*DumpItem {
+	var items = make(map[string]*DumpItem, len(d))
+	for i := range d {
+		items[d[i].Key] = &d[i]
+	}
+	return items
+}
+
+// JSON export of the dump
+func (d ConfigDump) JSON() ([]byte, error) {
+	return json.MarshalIndent(d, "", "  ")
+}
+
+// YAML export of the dump
+func (d ConfigDump) YAML() ([]byte, error) {
+	return yaml.Marshal(d)
+}
+
+// DiffItem describes the change of the key, Old or New is nil
+// if the key is absent in the corresponding dump
+type DiffItem struct {
+	Key string    `json:"key" yaml:"key"`
+	Old *DumpItem `json:"old,omitempty" yaml:"old,omitempty"`
+	New *DumpItem `json:"new,omitempty" yaml:"new,omitempty"`
+}
+
+// Diff returns changes of values between two dumps sorted by keys.
+// Dumps can be in any order, e.g. loaded from files.
+// Values of different types are compared by the string representation,
+// so the dump of expected string values can be compared with the typed config.
+func Diff(old, new ConfigDump) []DiffItem {
+	return diff(old, new, false)
+}
+
+// DiffStates returns changes of values and states of keys between two dumps
+func DiffStates(old, new ConfigDump) []DiffItem {
+	return diff(old, new, true)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Intenal methods
+///////////////////////////////////////////////////////////////////////////////
+
+func diff(old, new ConfigDump, states bool) (diff []DiffItem) {
+	var oldItems, newItems = old.items(), new.items()
+	var keys = map[string]bool{}
+	for key := range oldItems {
+		keys[key] = true
+	}
+	for key := range newItems {
+		keys[key] = true
+	}
+
+	for key := range keys {
+		var oldItem, newItem = oldItems[key], newItems[key]
+		if nil != oldItem && nil != newItem && equalValues(oldItem.Value, newItem.Value) &&
+			(!states || oldItem.State == newItem.State) {
+			continue
+		}
+		diff = append(diff, DiffItem{Key: key, Old: oldItem, New: newItem})
+	}
+
+	sort.Slice(diff, func(i, j int) bool { return diff[i].Key < diff[j].Key })
+	return
+}
+
+// dump flattened values of the last consistent copy of the config
+func (wr *bindWrapper) dump() (dump ConfigDump) {
+	wr.Lock()
+	defer wr.Unlock()
+
+	wr.eachField(reflect.ValueOf(wr.current.Load()), "", func(key string, opts tagOptions, field reflect.Value) error {
+		wr.dumpValue(&dump, key, opts, field)
+		return nil
+	})
+
+	sort.Slice(dump, func(i, j int) bool { return dump[i].Key < dump[j].Key })
+	return
+}
+
+// dumpValue adds items of the value, containers are flattened
+// into subkeys, decodable values are dumped as is
+func (wr *bindWrapper) dumpValue(dump *ConfigDump, key string, opts tagOptions, ref reflect.Value) {
+	if !isDecodable(ref.Type(), opts.format) {
+		switch ref.Kind() {
+		case reflect.Ptr:
+			if !ref.IsNil() {
+				wr.dumpValue(dump, key, opts, ref.Elem())
+				return
+			}
+		case reflect.Map:
+			if ref.Len() > 0 && ref.Type().Key().Kind() == reflect.String {
+				var keys = ref.MapKeys()
+				sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+				for _, k := range keys {
+					wr.dumpValue(dump, key+string(wr.tagSeparator)+k.String(), opts, ref.MapIndex(k))
+				}
+				return
+			}
+		case reflect.Slice, reflect.Array:
+			if ref.Len() > 0 {
+				for i := 0; i < ref.Len(); i++ {
+					wr.dumpValue(dump, key+string(wr.tagSeparator)+fmt.Sprint(i), opts, ref.Index(i))
+				}
+				return
+			}
+		case reflect.Struct:
+			wr.eachField(ref, key, func(key string, opts tagOptions, field reflect.Value) error {
+				wr.dumpValue(dump, key, opts, field)
+				return nil
+			})
+			return
+		}
+	}
+
+	var value interface{}
+	if ref.Kind() != reflect.Ptr || !ref.IsNil() {
+		value = ref.Interface()
+	}
+
+	*dump = append(*dump, DumpItem{
+		Key:    key,
+		Value:  wr.redact(key, value),
+		State:  wr.keyState(key, opts),
+		Secret: wr.isSecret(key),
+	})
+}
+
+// keyState returns the state of the key value
+func (wr *bindWrapper) keyState(key string, opts tagOptions) string {
+	switch {
+	case wr.hasValue(key, false):
+		return KeyBound
+	case opts.hasDefault():
+		return KeyDefault
+	}
+	return KeyUnbound
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Helpers
+///////////////////////////////////////////////////////////////////////////////
+
+func equalValues(v1, v2 interface{}) bool {
+	if reflect.DeepEqual(v1, v2) {
+		return true
+	}
+	if nil == v1 || nil == v2 {
+		return false
+	}
+	return gocast.ToString(v1) == gocast.ToString(v2)
+}
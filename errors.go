@@ -5,11 +5,59 @@
 
 package registry
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 // Errors set
 var (
-	ErrUnbindedConfig      = errors.New("Config is not bind")
-	ErrInvalidKeyParam     = errors.New("Invalid key params")
-	ErrInvalidTargetStruct = errors.New("Invalid bind target struct")
+	ErrUnbindedConfig       = errors.New("Config is not bind")
+	ErrAlreadyBindedConfig  = errors.New("Config is already bind")
+	ErrInvalidKeyParam      = errors.New("Invalid key params")
+	ErrInvalidTargetStruct  = errors.New("Invalid bind target struct")
+	ErrUnsupportedFormat    = errors.New("Unsupported value format")
+	ErrInvalidSecretValue   = errors.New("Invalid secret value")
+	ErrServiceNotFound      = errors.New("Service not found")
+	ErrNoHealthyUpstream    = errors.New("No healthy upstream")
+	ErrSliceIndexOutOfRange = errors.New("Slice index is out of range")
 )
+
+// RequiredKeysError contains the list of required keys which have no value
+type RequiredKeysError struct {
+	Keys []string
+}
+
+func (e *RequiredKeysError) Error() string {
+	return "Required config keys are missing: " + strings.Join(e.Keys, ", ")
+}
+
+// ValidationError of the config update, the update is rejected
+type ValidationError struct {
+	Keys []string
+	Err  error
+}
+
+func (e *ValidationError) Error() string {
+	return "Invalid config update [" + strings.Join(e.Keys, ", ") + "]: " + e.Err.Error()
+}
+
+// BindError describes the error of the storage or of the config update
+type BindError struct {
+	Storage Storage
+	Key     string
+	Value   interface{}
+	Target  interface{}
+	Err     error
+}
+
+func (e BindError) Error() string {
+	switch {
+	case e.Key != "":
+		return fmt.Sprintf("Bind %T key [%s] value [%v]: %s", e.Target, e.Key, e.Value, e.Err)
+	case e.Target != nil:
+		return fmt.Sprintf("Bind %T: %s", e.Target, e.Err)
+	}
+	return fmt.Sprintf("Storage %T: %s", e.Storage, e.Err)
+}
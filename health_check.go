@@ -0,0 +1,286 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/geniusrabbit/registry/service"
+)
+
+// Default values of the health check options
+const (
+	DefaultHealthCheckTimeout            = time.Second * 2
+	DefaultHealthCheckUnhealthyThreshold = 2
+)
+
+// HealthChecker of the service instance, returns nil if the instance is healthy
+type HealthChecker interface {
+	Check(ctx context.Context, srv *service.Service) error
+}
+
+// HealthCheckerFunc wrapper of the function as HealthChecker
+type HealthCheckerFunc func(ctx context.Context, srv *service.Service) error
+
+// Check the service instance
+func (f HealthCheckerFunc) Check(ctx context.Context, srv *service.Service) error {
+	return f(ctx, srv)
+}
+
+// DefaultHealthChecker sends GET request to the HTTP check URL of the service,
+// any 2xx response is healthy. If the service has no HTTP check then it
+// connects to the TCP check address or to the host of the service.
+// Check URLs are known from memory and etcd discoveries, services
+// of consul discovery are checked by the connection to the host.
+var DefaultHealthChecker HealthChecker = HealthCheckerFunc(checkService)
+
+// HealthCheck options of the active health checking of upstream hosts.
+// The result of checks is combined with the status of the service from
+// the registry, the host is used only if both of them are healthy.
+// New hosts are unhealthy until the first successful check.
+type HealthCheck struct {
+	// Interval between checks, zero disables the checking
+	Interval time.Duration
+
+	// Timeout of one check if the service has no own timeout
+	Timeout time.Duration
+
+	// HealthyThreshold of successful checks in a row to mark the host healthy, default is 1
+	HealthyThreshold int
+
+	// UnhealthyThreshold of failed checks in a row to mark the host unhealthy
+	UnhealthyThreshold int
+
+	// Checker of hosts, by default it's DefaultHealthChecker
+	Checker HealthChecker
+}
+
+// Enabled returns true if the checking interval is defined
+func (h HealthCheck) Enabled() bool {
+	return h.Interval > 0
+}
+
+// withDefaults returns options with default values of undefined fields
+func (h HealthCheck) withDefaults() HealthCheck {
+	if h.Timeout <= 0 {
+		h.Timeout = DefaultHealthCheckTimeout
+	}
+	if h.HealthyThreshold < 1 {
+		h.HealthyThreshold = 1
+	}
+	if h.UnhealthyThreshold < 1 {
+		h.UnhealthyThreshold = DefaultHealthCheckUnhealthyThreshold
+	}
+	if nil == h.Checker {
+		h.Checker = DefaultHealthChecker
+	}
+	return h
+}
+
+// hostHealth reports results of the active health checking of hosts
+type hostHealth interface {
+	healthy(host string) bool
+}
+
+type healthState struct {
+	service   service.Service
+	checked   bool
+	healthy   bool
+	successes int
+	failures  int
+}
+
+// healthMonitor checks hosts of all services of the balancer
+// and calls onChange if some host changed the state
+type healthMonitor struct {
+	mx       sync.RWMutex
+	options  HealthCheck
+	hosts    map[string]*healthState
+	onChange func()
+}
+
+func newHealthMonitor(options HealthCheck, onChange func()) *healthMonitor {
+	return &healthMonitor{
+		options:  options.withDefaults(),
+		hosts:    map[string]*healthState{},
+		onChange: onChange,
+	}
+}
+
+// update the list of checked hosts, states of known hosts are kept
+func (m *healthMonitor) update(services []*service.Service) {
+	var hosts = make(map[string]*healthState, len(services))
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	for _, srv := range services {
+		var host = srv.Host()
+		if st, ok := m.hosts[host]; ok {
+			st.service = *srv
+			hosts[host] = st
+		} else {
+			hosts[host] = &healthState{service: *srv}
+		}
+	}
+	m.hosts = hosts
+}
+
+// healthy returns false if the host failed the checks or was not checked yet,
+// hosts which are not monitored are healthy
+func (m *healthMonitor) healthy(host string) bool {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	if st, ok := m.hosts[host]; ok {
+		return st.healthy
+	}
+	return true
+}
+
+// run checks until the stop channel is closed
+func (m *healthMonitor) run(stop <-chan bool) {
+	var ticker = time.NewTicker(m.options.Interval)
+	defer ticker.Stop()
+
+	m.checkAll()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.checkAll()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// checkAll hosts concurrently and apply results
+func (m *healthMonitor) checkAll() {
+	m.mx.RLock()
+	var services = make([]service.Service, 0, len(m.hosts))
+	for _, st := range m.hosts {
+		services = append(services, st.service)
+	}
+	m.mx.RUnlock()
+
+	var (
+		wg      sync.WaitGroup
+		results = make([]error, len(services))
+	)
+
+	for i := range services {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = m.check(&services[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var changed bool
+
+	m.mx.Lock()
+	for i, srv := range services {
+		if st, ok := m.hosts[srv.Host()]; ok && st.report(results[i], m.options) {
+			changed = true
+		}
+	}
+	m.mx.Unlock()
+
+	if changed && nil != m.onChange {
+		m.onChange()
+	}
+}
+
+func (m *healthMonitor) check(srv *service.Service) error {
+	var timeout = m.options.Timeout
+	if d, err := time.ParseDuration(srv.Check.Timeout); nil == err && d > 0 {
+		timeout = d
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return m.options.Checker.Check(ctx, srv)
+}
+
+// report the check result, returns true if the state is changed.
+// The first result defines the state of the new host.
+func (st *healthState) report(err error, options HealthCheck) bool {
+	if !st.checked {
+		st.checked, st.healthy = true, nil == err
+		if st.healthy {
+			st.successes = 1
+		} else {
+			st.failures = 1
+		}
+		return st.healthy
+	}
+
+	if nil == err {
+		st.successes++
+		st.failures = 0
+		if !st.healthy && st.successes >= options.HealthyThreshold {
+			st.healthy = true
+			return true
+		}
+		return false
+	}
+
+	st.failures++
+	st.successes = 0
+	if st.healthy && st.failures >= options.UnhealthyThreshold {
+		st.healthy = false
+		return true
+	}
+	return false
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Helpers
+///////////////////////////////////////////////////////////////////////////////
+
+func checkService(ctx context.Context, srv *service.Service) error {
+	if len(srv.Check.HTTP) > 0 {
+		return checkHTTP(ctx, srv.Check.HTTP)
+	}
+	if len(srv.Check.TCP) > 0 {
+		return checkTCP(ctx, srv.Check.TCP)
+	}
+	return checkTCP(ctx, srv.Host())
+}
+
+func checkHTTP(ctx context.Context, url string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if nil != err {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if nil != err {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Health check [%s]: %s", url, resp.Status)
+	}
+	return nil
+}
+
+func checkTCP(ctx context.Context, address string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if nil != err {
+		return err
+	}
+	return conn.Close()
+}
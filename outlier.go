@@ -0,0 +1,275 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package registry
+
+import "time"
+
+const outlierWindowBuckets = 10
+
+// Default values of the outlier detection options
+const (
+	DefaultOutlierWindow           = time.Second * 10
+	DefaultOutlierMinRequests      = 10
+	DefaultOutlierBaseEjectionTime = time.Second * 30
+)
+
+// OutlierDetection options of the passive health checking of upstream hosts
+// by results of returned connections. The host is ejected after consecutive
+// errors or if the error rate over the sliding window is too high. After the
+// ejection time the host becomes half-open and gets probe requests one by one,
+// successful probes restore the host, the failed probe ejects it again for
+// the doubled time. The probe which is not returned during the ProbeTimeout
+// is lost and the next probe is allowed.
+type OutlierDetection struct {
+	// ConsecutiveErrors to eject the host, zero disables the check
+	ConsecutiveErrors int
+
+	// ErrorRate from 0 to 1 over the Window to eject the host, zero disables the check
+	ErrorRate float64
+
+	// MinRequests in the Window to check the error rate
+	MinRequests int
+
+	// Window of the error rate
+	Window time.Duration
+
+	// BaseEjectionTime of the first ejection, next ejections are doubled
+	BaseEjectionTime time.Duration
+
+	// MaxEjectionTime is the limit of the ejection time,
+	// by default it's ten times of BaseEjectionTime
+	MaxEjectionTime time.Duration
+
+	// SuccessProbes in the half-open state to restore the host, default is 1
+	SuccessProbes int
+
+	// ProbeTimeout of the probe in the half-open state,
+	// by default it's BaseEjectionTime
+	ProbeTimeout time.Duration
+}
+
+// Enabled returns true if any check is defined
+func (o OutlierDetection) Enabled() bool {
+	return o.ConsecutiveErrors > 0 || o.ErrorRate > 0
+}
+
+// withDefaults returns options with default values of undefined fields
+func (o OutlierDetection) withDefaults() OutlierDetection {
+	if o.Window <= 0 {
+		o.Window = DefaultOutlierWindow
+	}
+	if o.MinRequests < 1 {
+		o.MinRequests = DefaultOutlierMinRequests
+	}
+	if o.BaseEjectionTime <= 0 {
+		o.BaseEjectionTime = DefaultOutlierBaseEjectionTime
+	}
+	if o.MaxEjectionTime < o.BaseEjectionTime {
+		o.MaxEjectionTime = o.BaseEjectionTime * 10
+	}
+	if o.SuccessProbes < 1 {
+		o.SuccessProbes = 1
+	}
+	if o.ProbeTimeout <= 0 {
+		o.ProbeTimeout = o.BaseEjectionTime
+	}
+	return o
+}
+
+// States of the host
+const (
+	hostClosed = iota
+	hostOpen
+	hostHalfOpen
+)
+
+type hostState struct {
+	state        int
+	consecutive  int
+	ejections    int
+	ejectedUntil time.Time
+	restoredAt   time.Time
+	probing      bool
+	probeStarted time.Time
+	probes       int
+	window       errorWindow
+}
+
+// outlierDetector keeps states of hosts of one upstream,
+// calls are serialized by the upstream
+type outlierDetector struct {
+	options OutlierDetection
+	hosts   map[string]*hostState
+}
+
+func newOutlierDetector(options OutlierDetection) *outlierDetector {
+	return &outlierDetector{
+		options: options.withDefaults(),
+		hosts:   map[string]*hostState{},
+	}
+}
+
+// allow returns true if the host can get the request.
+// The half-open host gets only one probe at the time,
+// the lost probe is cleared after the probe timeout.
+func (d *outlierDetector) allow(host string, now time.Time) bool {
+	var st = d.hosts[host]
+	if nil == st {
+		return true
+	}
+
+	if st.state == hostOpen && !now.Before(st.ejectedUntil) {
+		st.state, st.probing, st.probes = hostHalfOpen, false, 0
+	}
+
+	if st.probing && now.Sub(st.probeStarted) >= d.options.ProbeTimeout {
+		st.probing = false
+	}
+
+	switch st.state {
+	case hostOpen:
+		return false
+	case hostHalfOpen:
+		return !st.probing
+	}
+	return true
+}
+
+// borrowed marks the probe of the half-open host
+func (d *outlierDetector) borrowed(host string, now time.Time) {
+	if st := d.hosts[host]; nil != st && st.state == hostHalfOpen {
+		st.probing, st.probeStarted = true, now
+	}
+}
+
+// prune states of hosts which are not in the upstream anymore
+func (d *outlierDetector) prune(hosts map[string]bool) {
+	for host := range d.hosts {
+		if !hosts[host] {
+			delete(d.hosts, host)
+		}
+	}
+}
+
+// report the result of the request to the host
+func (d *outlierDetector) report(host string, err error, now time.Time) {
+	var st = d.hosts[host]
+	if nil == st {
+		st = &hostState{window: errorWindow{size: d.options.Window}}
+		d.hosts[host] = st
+	}
+
+	switch st.state {
+	case hostHalfOpen:
+		st.probing = false
+		if nil != err {
+			d.eject(st, now)
+		} else if st.probes++; st.probes >= d.options.SuccessProbes {
+			d.restore(st, now)
+		}
+	case hostClosed:
+		st.window.add(now, nil != err)
+		if nil == err {
+			st.consecutive = 0
+			return
+		}
+
+		st.consecutive++
+		if d.options.ConsecutiveErrors > 0 && st.consecutive >= d.options.ConsecutiveErrors {
+			d.eject(st, now)
+			return
+		}
+
+		if d.options.ErrorRate > 0 {
+			if total, errors := st.window.count(now); total >= d.options.MinRequests &&
+				float64(errors)/float64(total) >= d.options.ErrorRate {
+				d.eject(st, now)
+			}
+		}
+	}
+}
+
+// eject the host for the exponentially growing time, the counter of ejections
+// is reset if the host worked well during the max ejection time after restore
+func (d *outlierDetector) eject(st *hostState, now time.Time) {
+	if st.state == hostClosed && now.Sub(st.restoredAt) > d.options.MaxEjectionTime {
+		st.ejections = 0
+	}
+
+	var duration = d.options.BaseEjectionTime
+	for i := 0; i < st.ejections && duration < d.options.MaxEjectionTime; i++ {
+		duration *= 2
+	}
+	if duration > d.options.MaxEjectionTime {
+		duration = d.options.MaxEjectionTime
+	}
+
+	st.ejections++
+	st.state = hostOpen
+	st.ejectedUntil = now.Add(duration)
+	st.probing = false
+}
+
+// restore the host after successful probes
+func (d *outlierDetector) restore(st *hostState, now time.Time) {
+	st.state = hostClosed
+	st.consecutive = 0
+	st.restoredAt = now
+	st.window.reset()
+}
+
+// errorWindow counts requests and errors over the sliding window by buckets
+type errorWindow struct {
+	size    time.Duration
+	buckets [outlierWindowBuckets]struct {
+		start  int64
+		total  int
+		errors int
+	}
+}
+
+func (w *errorWindow) add(now time.Time, failed bool) {
+	var (
+		start  = w.bucketStart(now)
+		bucket = &w.buckets[start%outlierWindowBuckets]
+	)
+
+	if bucket.start != start {
+		bucket.start, bucket.total, bucket.errors = start, 0, 0
+	}
+
+	bucket.total++
+	if failed {
+		bucket.errors++
+	}
+}
+
+// count of requests and errors over the window
+func (w *errorWindow) count(now time.Time) (total, errors int) {
+	var start = w.bucketStart(now)
+	for _, bucket := range w.buckets {
+		if start-bucket.start < outlierWindowBuckets {
+			total += bucket.total
+			errors += bucket.errors
+		}
+	}
+	return
+}
+
+func (w *errorWindow) reset() {
+	for i := range w.buckets {
+		w.buckets[i].start, w.buckets[i].total, w.buckets[i].errors = 0, 0, 0
+	}
+}
+
+// bucketStart returns the number of the bucket of the time
+func (w *errorWindow) bucketStart(now time.Time) int64 {
+	var bucketSize = int64(w.size) / outlierWindowBuckets
+	if bucketSize < 1 {
+		bucketSize = 1
+	}
+	return now.UnixNano() / bucketSize
+}
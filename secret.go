@@ -0,0 +1,155 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package registry
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+
+	"github.com/demdxx/gocast"
+)
+
+// RedactedValue replaces values of secret keys in errors and dumps
+const RedactedValue = "******"
+
+// Decrypter of values of fields with the tag option `secret`.
+// The value from the storage is passed as is, the result is used
+// as the value of the field.
+type Decrypter interface {
+	Decrypt(data []byte) ([]byte, error)
+}
+
+// DecrypterFunc wraps the function into the Decrypter
+type DecrypterFunc func(data []byte) ([]byte, error)
+
+// Decrypt data by the function
+func (f DecrypterFunc) Decrypt(data []byte) ([]byte, error) {
+	return f(data)
+}
+
+// aesDecrypter of values encrypted by AES-GCM
+type aesDecrypter struct {
+	aead cipher.AEAD
+}
+
+// NewAESDecrypter of values encrypted by AES-GCM with the key of 16, 24 or 32 bytes.
+// The value is base64 encoded nonce followed by the ciphertext.
+func NewAESDecrypter(key []byte) (Decrypter, error) {
+	block, err := aes.NewCipher(key)
+	if nil != err {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if nil != err {
+		return nil, err
+	}
+	return &aesDecrypter{aead: aead}, nil
+}
+
+// NewAESDecrypterFromFile with the key from the file,
+// the key can be stored as raw bytes or base64 encoded
+func NewAESDecrypterFromFile(filename string) (Decrypter, error) {
+	data, err := ioutil.ReadFile(filename)
+	if nil != err {
+		return nil, err
+	}
+
+	var key = bytes.TrimSpace(data)
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		if key, err = base64.StdEncoding.DecodeString(string(key)); nil != err {
+			return nil, err
+		}
+	}
+	return NewAESDecrypter(key)
+}
+
+// Decrypt base64 encoded nonce and ciphertext
+func (d *aesDecrypter) Decrypt(data []byte) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if nil != err {
+		return nil, err
+	}
+
+	var size = d.aead.NonceSize()
+	if len(raw) < size {
+		return nil, ErrInvalidSecretValue
+	}
+	return d.aead.Open(nil, raw[:size], raw[size:], nil)
+}
+
+// sealedValue of the secret key which is kept in layers of the bind
+type sealedValue []byte
+
+// sealer encrypts secret values by the random key, so they are
+// not kept in plaintext while they are not applied to the config
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer() *sealer {
+	block, err := aes.NewCipher(randomBytes(32))
+	if nil != err {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if nil != err {
+		panic(err)
+	}
+	return &sealer{aead: aead}
+}
+
+// seal the value, the sealed value is opened as the string
+func (s *sealer) seal(value interface{}) sealedValue {
+	data, ok := rawValue(value)
+	if !ok {
+		data = []byte(gocast.ToString(value))
+	}
+	var nonce = randomBytes(s.aead.NonceSize())
+	return s.aead.Seal(nonce, nonce, data, nil)
+}
+
+// open the sealed value
+func (s *sealer) open(value sealedValue) (interface{}, error) {
+	var size = s.aead.NonceSize()
+	if len(value) < size {
+		return nil, ErrInvalidSecretValue
+	}
+	data, err := s.aead.Open(nil, value[:size], value[size:], nil)
+	if nil != err {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Helpers
+///////////////////////////////////////////////////////////////////////////////
+
+// secretDigest of the value which is kept instead of the plain secret,
+// the salt is random for every bound config
+func secretDigest(salt []byte, value string) string {
+	var mac = hmac.New(sha256.New, salt)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func randomBytes(size int) []byte {
+	var data = make([]byte, size)
+	if _, err := rand.Read(data); nil != err {
+		panic(err)
+	}
+	return data
+}
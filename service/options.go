@@ -48,6 +48,7 @@ func (o *Options) Service() *Service {
 		Port:       int(portInt),
 		Tags:       o.Tags,
 		Status:     StatusUndefined,
+		Check:      o.Check,
 		weight:     WeightByTags(o.Tags),
 	}
 }
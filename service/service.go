@@ -29,6 +29,7 @@ type Service struct {
 	Port       int
 	Tags       []string
 	Status     int8
+	Check      CheckInfo
 	weight     int
 }
 
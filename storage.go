@@ -6,6 +6,7 @@
 package registry
 
 import (
+	"context"
 	"time"
 
 	"github.com/geniusrabbit/registry/service"
@@ -22,3 +23,59 @@ type Storage interface {
 	// Supervisor of auto refresh
 	Supervisor(interval time.Duration)
 }
+
+// Loader is an optional storage interface of the synchronous
+// loading of all current values
+type Loader interface {
+	// Load full snapshot of values
+	Load(ctx context.Context) (map[string]interface{}, error)
+}
+
+// BatchStorage is an optional storage interface which delivers all
+// changes of one refresh cycle together, removed keys have nil value
+type BatchStorage interface {
+	// SubscribeBatch config changes updater
+	SubscribeBatch(f func(values map[string]interface{}))
+}
+
+// CancelableStorage is an optional storage interface of subscriptions
+// which can be removed, it's used to detach unbound configs
+type CancelableStorage interface {
+	// SubscribeCancelable config key updater
+	SubscribeCancelable(f func(key string, value interface{})) (cancel func())
+
+	// SubscribeBatchCancelable config changes updater
+	SubscribeBatchCancelable(f func(values map[string]interface{})) (cancel func())
+}
+
+// ErrorReporter is an optional storage interface
+// which reports errors of the background refresh
+type ErrorReporter interface {
+	// OnError registers the handler of storage errors
+	OnError(f func(err error))
+}
+
+// NamedStorage is an optional storage interface which
+// identifies the storage in dumps of the config
+type NamedStorage interface {
+	// Name of the storage, e.g. `consul:myapp`
+	Name() string
+}
+
+// WritableStorage is an optional storage interface which allows
+// to change config values from the application
+type WritableStorage interface {
+	// Get value of the key and the modify index of the value,
+	// the index is zero if the key is not exists
+	Get(key string) (value string, index uint64, err error)
+
+	// Set value of the key
+	Set(key, value string) error
+
+	// Delete the key
+	Delete(key string) error
+
+	// CompareAndSwap sets value of the key only if the modify index
+	// of the key was not changed, zero index means that the key must not exist
+	CompareAndSwap(key, value string, index uint64) (bool, error)
+}
@@ -109,7 +109,10 @@ func (d *discovery) Lookup(filter *service.Filter) (services []*service.Service,
 /// Internal methods
 ///////////////////////////////////////////////////////////////////////////////
 
-// Lookup services by filter
+// Lookup services by filter.
+// Catalog of consul doesn't return definitions of health checks, so the Check
+// of services is empty and the active health checking of the balancer connects
+// to addresses of services. Statuses of consul checks are used as is.
 func (d *discovery) lookup(filter *service.Filter) (result []*service.Service, err error) {
 	var (
 		names    []string
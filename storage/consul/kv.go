@@ -6,24 +6,29 @@
 package consul
 
 import (
+	"context"
+	"strings"
+	"time"
+
 	"github.com/hashicorp/consul/api"
 )
 
 type kv struct {
 	prefix string
+	nested []string // more specific prefixes which are not values of the prefix
 	client *api.KV
 }
 
-// Get value
-func (kv kv) Get(key string) (string, error) {
+// Get value and the modify index, the index is zero if the key is not exists
+func (kv kv) Get(key string) (string, uint64, error) {
 	v, _, err := kv.client.Get(kv.key(key), nil)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	if v != nil {
-		return string(v.Value), nil
+		return string(v.Value), v.ModifyIndex, nil
 	}
-	return "", nil
+	return "", 0, nil
 }
 
 // Set value for key
@@ -35,19 +40,35 @@ func (kv kv) Set(key, value string) (err error) {
 	return err
 }
 
-// List of valuse
-func (kv kv) List(prefix string) (map[string]string, error) {
-	var items, _, err = kv.client.List(prefix, nil)
+// CAS sets value for key only if the modify index was not changed,
+// zero index means that the key must not exist
+func (kv kv) CAS(key, value string, index uint64) (ok bool, err error) {
+	ok, _, err = kv.client.CAS(&api.KVPair{
+		Key:         kv.key(key),
+		Value:       []byte(value),
+		ModifyIndex: index,
+	}, nil)
+	return ok, err
+}
+
+// List of values under the prefix of kv, keys are relative to the prefix
+func (kv kv) List() (map[string]string, error) {
+	var items, _, err = kv.client.List(kv.key(""), nil)
 	if err != nil {
 		return nil, err
 	}
+	return kv.values(items), nil
+}
 
-	var list = make(map[string]string, len(items))
-	for _, k := range items {
-		list[k.Key] = string(k.Value)
+// Watch values by blocking query which returns after changes
+// of the index or when the wait time is over
+func (kv kv) Watch(ctx context.Context, index uint64, wait time.Duration) (map[string]string, uint64, error) {
+	var q = &api.QueryOptions{WaitIndex: index, WaitTime: wait}
+	var items, meta, err = kv.client.List(kv.key(""), q.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
 	}
-
-	return list, nil
+	return kv.values(items), meta.LastIndex, nil
 }
 
 // Delete item by key
@@ -62,3 +83,27 @@ func (kv kv) key(k string) string {
 	}
 	return k
 }
+
+// values of items with keys relative to the prefix,
+// folders and keys of nested prefixes are skipped
+func (kv kv) values(items api.KVPairs) map[string]string {
+	var list = make(map[string]string, len(items))
+	for _, item := range items {
+		var key = strings.TrimPrefix(item.Key, kv.key(""))
+		if key == "" || strings.HasSuffix(key, "/") || kv.isNested(item.Key) {
+			continue
+		}
+		list[key] = string(item.Value)
+	}
+	return list
+}
+
+// isNested returns true if the key belongs to the nested prefix
+func (kv kv) isNested(key string) bool {
+	for _, prefix := range kv.nested {
+		if strings.HasPrefix(key, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,268 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/geniusrabbit/registry"
+)
+
+var _ registry.WritableStorage = (*Storage)(nil)
+
+// testServer emulates the KV API of consul with blocking queries
+type testServer struct {
+	sync.Mutex
+	*httptest.Server
+	index   uint64
+	items   map[string]*api.KVPair
+	changed chan bool // closed after every change
+}
+
+func newTestServer() *testServer {
+	var s = &testServer{items: map[string]*api.KVPair{}, changed: make(chan bool)}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		key   = strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		query = r.URL.Query()
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		s.wait(r)
+		s.Lock()
+		defer s.Unlock()
+
+		var (
+			items      api.KVPairs
+			_, recurse = query["recurse"]
+		)
+		for k, item := range s.items {
+			if k == key || recurse && strings.HasPrefix(k, key) {
+				items = append(items, item)
+			}
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+		w.Header().Set("X-Consul-LastContact", "0")
+		if len(items) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(items)
+	case http.MethodPut:
+		var value, _ = ioutil.ReadAll(r.Body)
+		s.Lock()
+		defer s.Unlock()
+
+		var item = s.items[key]
+		if cas := query.Get("cas"); cas != "" {
+			var index, _ = strconv.ParseUint(cas, 10, 64)
+			if (nil == item && index != 0) || (nil != item && item.ModifyIndex != index) {
+				w.Write([]byte("false"))
+				return
+			}
+		}
+		s.index++
+		if nil == item {
+			item = &api.KVPair{Key: key, CreateIndex: s.index}
+		}
+		item.Value, item.ModifyIndex = value, s.index
+		s.items[key] = item
+		s.notify()
+		w.Write([]byte("true"))
+	case http.MethodDelete:
+		s.Lock()
+		defer s.Unlock()
+
+		s.index++
+		delete(s.items, key)
+		s.notify()
+		w.Write([]byte("true"))
+	}
+}
+
+// wait changes if the request is blocking query
+func (s *testServer) wait(r *http.Request) {
+	var index, _ = strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	var wait, _ = time.ParseDuration(r.URL.Query().Get("wait"))
+
+	s.Lock()
+	var changed = s.changed
+	var blocking = index > 0 && index >= s.index
+	s.Unlock()
+
+	if blocking {
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// notify blocking queries, must be called under the lock
+func (s *testServer) notify() {
+	close(s.changed)
+	s.changed = make(chan bool)
+}
+
+func (s *testServer) value(key string) string {
+	s.Lock()
+	defer s.Unlock()
+	if item := s.items[key]; nil != item {
+		return string(item.Value)
+	}
+	return ""
+}
+
+func TestKVValues(t *testing.T) {
+	var values = kv{prefix: "myapp"}.values(api.KVPairs{
+		{Key: "myapp/"},
+		{Key: "myapp/service/", Value: nil},
+		{Key: "myapp/service/name", Value: []byte("test")},
+		{Key: "myapp/service/port", Value: []byte("8080")},
+	})
+	assert.Equal(t, map[string]string{"service/name": "test", "service/port": "8080"}, values)
+}
+
+func TestKVValuesNested(t *testing.T) {
+	var values = kv{prefix: "myapp", nested: []string{"myapp/dc1"}}.values(api.KVPairs{
+		{Key: "myapp/service/name", Value: []byte("test")},
+		{Key: "myapp/dc1/service/name", Value: []byte("dc1")},
+		{Key: "myapp/dc10/key", Value: []byte("value")},
+	})
+	assert.Equal(t, map[string]string{"service/name": "test", "dc10/key": "value"}, values)
+}
+
+func TestStorageMerge(t *testing.T) {
+	var s = &Storage{prefixes: []string{"shared", "myapp", "myapp/dc1"}}
+	var values = s.update([]map[string]string{
+		{"service/name": "shared", "db/host": "db.shared"},
+		{"service/name": "myapp"},
+		{"db/host": "db.dc1"},
+	})
+	assert.Equal(t, map[string]string{"service/name": "myapp", "db/host": "db.dc1"}, values)
+
+	s.updateLayer(1, map[string]string{})
+	assert.Equal(t, map[string]string{"service/name": "shared", "db/host": "db.dc1"}, s.merge())
+}
+
+func TestStorageWrite(t *testing.T) {
+	var server = newTestServer()
+	defer server.Close()
+
+	s, err := NewWithPrefixes(server.URL+"/dc1", "shared", "myapp")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, s.Set("service/name", "test"))
+	assert.Equal(t, "test", server.value("myapp/service/name"), "Values are written to the last prefix")
+
+	value, index, err := s.Get("service/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "test", value)
+	assert.NotEqual(t, uint64(0), index)
+
+	ok, err := s.CompareAndSwap("service/name", "changed", index)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = s.CompareAndSwap("service/name", "lost", index)
+	assert.NoError(t, err)
+	assert.False(t, ok, "Modify index is changed")
+	assert.Equal(t, "changed", server.value("myapp/service/name"))
+
+	ok, _ = s.CompareAndSwap("service/name", "lost", 0)
+	assert.False(t, ok, "Key already exists")
+
+	assert.NoError(t, s.Delete("service/name"))
+	value, index, err = s.Get("service/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "", value)
+	assert.Equal(t, uint64(0), index)
+}
+
+func TestStorageLoad(t *testing.T) {
+	var server = newTestServer()
+	defer server.Close()
+
+	var prefixes = []string{"/shared/", "myapp/", "myapp/dc1"}
+	s, err := NewWithPrefixes(server.URL+"/dc1", prefixes...)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"/shared/", "myapp/", "myapp/dc1"}, prefixes, "Prefixes of the caller are not changed")
+
+	s.kv("shared").Set("service/name", "shared")
+	s.kv("shared").Set("db/host", "db.shared")
+	s.kv("myapp").Set("service/name", "myapp")
+	s.kv("myapp/dc1").Set("db/host", "db.dc1")
+
+	values, err := s.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"service/name": "myapp", "db/host": "db.dc1"}, values, "Keys of nested prefixes are not merged as values")
+}
+
+func TestStorageWatch(t *testing.T) {
+	var server = newTestServer()
+	defer server.Close()
+
+	s, err := NewWithPrefixes(server.URL+"/dc1?watch=true&wait=1s", "shared", "myapp")
+	if !assert.NoError(t, err) {
+		return
+	}
+	s.kv("shared").Set("service/name", "shared")
+
+	var updates = make(chan map[string]interface{}, 100)
+	s.SubscribeBatch(func(values map[string]interface{}) {
+		updates <- values
+	})
+	s.OnError(func(err error) {
+		t.Error(err)
+	})
+
+	go s.Supervisor(time.Millisecond * 10)
+	defer s.Stop()
+
+	var wait = func(key, value string) {
+		var timeout = time.After(time.Second * 3)
+		for {
+			select {
+			case values := <-updates:
+				if values[key] == value {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("Update %s=%s is not delivered", key, value)
+			}
+		}
+	}
+
+	wait("service/name", "shared")
+
+	s.Set("service/name", "myapp")
+	wait("service/name", "myapp")
+
+	s.Delete("service/name")
+	wait("service/name", "shared")
+}
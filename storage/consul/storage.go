@@ -6,52 +6,137 @@
 package consul
 
 import (
+	"context"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/geniusrabbit/registry/service"
+	"github.com/geniusrabbit/registry/storage/notifier"
 	"github.com/hashicorp/consul/api"
 )
 
-// Storage accessor to consul
+const defaultWaitTime = time.Minute * 5
+
+// Storage accessor to consul. Keys are relative to the prefix,
+// values of several prefixes are merged in order, so values
+// of the next prefix override values of the previous one.
 type Storage struct {
 	sync.Mutex
-	prefix      string
-	datacenter  string
-	client      *api.Client
-	subscribers []func(key string, value interface{})
-	ticker      *time.Ticker
+	notifier.Subscriptions
+	notifier   notifier.Notifier
+	prefixes   []string
+	layersMx   sync.Mutex
+	layers     []map[string]string
+	datacenter string
+	watch      bool
+	waitTime   time.Duration
+	client     *api.Client
+	stop       chan bool
 }
 
 // New storage connector
+//
+// Link example: http://localhost:8500/dc1?token=secret&watch=true&wait=1m
+//
+// With `watch` option the storage uses consul blocking queries
+// instead of the periodic polling, `wait` defines the max time of one query.
 func New(prefix, link string) (*Storage, error) {
+	return NewWithPrefixes(link, prefix)
+}
+
+// NewWithPrefixes storage connector which merges values of prefixes in order,
+// e.g. `shared`, `myapp`, `myapp/dc1` where the last prefix has the highest priority
+func NewWithPrefixes(link string, prefixes ...string) (*Storage, error) {
 	url, err := url.Parse(link)
 	if err != nil {
 		return nil, err
 	}
 
+	var (
+		query    = url.Query()
+		watch, _ = strconv.ParseBool(query.Get("watch"))
+		waitTime = defaultWaitTime
+	)
+
+	if wait := query.Get("wait"); wait != "" {
+		if waitTime, err = time.ParseDuration(wait); err != nil {
+			return nil, err
+		}
+	}
+
 	client, err := api.NewClient(&api.Config{
 		Scheme:     url.Scheme,
 		Address:    url.Host,
 		Datacenter: url.Path[1:],
-		Token:      url.Query().Get("token"),
+		Token:      query.Get("token"),
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &Storage{
-		prefix:     prefix,
+	var list = make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		list = append(list, strings.Trim(prefix, "/"))
+	}
+	if len(list) == 0 {
+		list = []string{""}
+	}
+
+	var s = &Storage{
+		prefixes:   list,
+		layers:     make([]map[string]string, len(list)),
 		datacenter: url.Path[1:],
+		watch:      watch,
+		waitTime:   waitTime,
 		client:     client,
-	}, nil
+	}
+	s.Subscriptions = s.notifier.Subscriptions()
+	return s, nil
 }
 
-// Subscribe config key updater
-func (s *Storage) Subscribe(f func(key string, value interface{})) {
-	s.subscribers = append(s.subscribers, f)
+// Load all current values synchronously
+func (s *Storage) Load(ctx context.Context) (map[string]interface{}, error) {
+	var layers = make([]map[string]string, len(s.prefixes))
+	for i, prefix := range s.prefixes {
+		// Query with zero index is not blocking
+		data, _, err := s.kv(prefix).Watch(ctx, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		layers[i] = data
+	}
+
+	var data = s.update(layers)
+	var values = make(map[string]interface{}, len(data))
+	for key, val := range data {
+		values[key] = val
+	}
+	return values, nil
+}
+
+// Get value of the key and the modify index of the value.
+// Write methods work with the last prefix of the storage.
+func (s *Storage) Get(key string) (string, uint64, error) {
+	return s.writer().Get(key)
+}
+
+// Set value of the key
+func (s *Storage) Set(key, value string) error {
+	return s.writer().Set(key, value)
+}
+
+// Delete the key
+func (s *Storage) Delete(key string) error {
+	return s.writer().Delete(key)
+}
+
+// CompareAndSwap sets value of the key only if the modify index was not changed
+func (s *Storage) CompareAndSwap(key, value string, index uint64) (bool, error) {
+	return s.writer().CAS(key, value, index)
 }
 
 // Discovery services
@@ -64,48 +149,162 @@ func (s *Storage) Discovery() service.Discovery {
 	}
 }
 
-// Supervisor of auto refresh
+// Supervisor of auto refresh.
+// In watch mode the interval is used as a delay before retry of failed query.
 func (s *Storage) Supervisor(interval time.Duration) {
 	s.Stop()
-	s.ticker = time.NewTicker(interval)
+
+	s.Lock()
+	var stop = make(chan bool)
+	s.stop = stop
+	s.Unlock()
+
+	if s.watch {
+		s.watchLoop(interval, stop)
+		return
+	}
+
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case <-s.ticker.C:
+		case <-ticker.C:
 			s.refresh()
+		case <-stop:
+			return
 		}
 	} // end for
 }
 
 // Stop supervisord
 func (s *Storage) Stop() {
-	if nil != s.ticker {
-		s.Lock()
-		s.ticker.Stop()
-		s.ticker = nil
-		s.Unlock()
+	s.Lock()
+	if nil != s.stop {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.Unlock()
+}
+
+// key value accessor of the prefix, keys of other
+// prefixes of the storage nested into it are skipped
+func (s *Storage) kv(prefix string) kv {
+	var nested []string
+	for _, p := range s.prefixes {
+		if p != prefix && (prefix == "" || strings.HasPrefix(p, prefix+"/")) {
+			nested = append(nested, p)
+		}
 	}
+	return kv{client: s.client.KV(), prefix: prefix, nested: nested}
 }
 
-// key value accessor
-func (s *Storage) kv() kv {
-	return kv{client: s.client.KV(), prefix: s.prefix}
+// writer key value accessor of the last prefix
+func (s *Storage) writer() kv {
+	return s.kv(s.prefixes[len(s.prefixes)-1])
 }
 
 // refresh subscribed events
 func (s *Storage) refresh() {
-	if len(s.subscribers) < 0 {
-		return
+	var layers = make([]map[string]string, len(s.prefixes))
+	for i, prefix := range s.prefixes {
+		data, err := s.kv(prefix).List()
+		if nil != err {
+			s.notifier.Error(err)
+			return
+		}
+		layers[i] = data
 	}
+	s.update(layers)
+}
 
-	var data, _ = s.kv().List(s.prefix)
-	if nil == data {
-		return
+// watchLoop waits changes by blocking queries of every prefix untill the stop
+func (s *Storage) watchLoop(interval time.Duration, stop chan bool) {
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		wg          sync.WaitGroup
+	)
+
+	for i := range s.prefixes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.watchPrefix(ctx, i, interval)
+		}(i)
 	}
 
-	for _, sub := range s.subscribers {
-		for key, val := range data {
-			sub(key, val)
+	<-stop
+	cancel()
+	wg.Wait()
+}
+
+// watchPrefix waits changes of one prefix untill the context is done
+func (s *Storage) watchPrefix(ctx context.Context, i int, interval time.Duration) {
+	var (
+		kv        = s.kv(s.prefixes[i])
+		lastIndex uint64
+	)
+
+	for {
+		data, index, err := kv.Watch(ctx, lastIndex, s.waitTime)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			s.notifier.Error(err)
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		switch {
+		case index < lastIndex:
+			// Index went backwards (consul restart), start from the scratch
+			lastIndex = 0
+		case index == lastIndex:
+			// Wait timeout without changes
+		default:
+			lastIndex = index
+			s.updateLayer(i, data)
+		}
+	} // end for
+}
+
+// update all layers and notify subscribers about merged values
+func (s *Storage) update(layers []map[string]string) map[string]string {
+	s.layersMx.Lock()
+	defer s.layersMx.Unlock()
+
+	s.layers = layers
+	var values = s.merge()
+	s.notifier.Update(values)
+	return values
+}
+
+// updateLayer of the prefix and notify subscribers about merged values
+func (s *Storage) updateLayer(i int, data map[string]string) {
+	s.layersMx.Lock()
+	defer s.layersMx.Unlock()
+
+	var layers = make([]map[string]string, len(s.layers))
+	copy(layers, s.layers)
+	layers[i] = data
+	s.layers = layers
+	s.notifier.Update(s.merge())
+}
+
+// merge values of layers in order of prefixes
+func (s *Storage) merge() map[string]string {
+	var values = map[string]string{}
+	for _, layer := range s.layers {
+		for key, val := range layer {
+			values[key] = val
 		}
 	}
+	return values
 }
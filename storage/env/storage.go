@@ -0,0 +1,147 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package env
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geniusrabbit/registry/service"
+	"github.com/geniusrabbit/registry/storage/notifier"
+)
+
+// Storage of config values from environment variables.
+// The key `service/listen` is mapped to the variable PREFIX_SERVICE_LISTEN,
+// keys with underscores in path elements have to be defined by Alias.
+type Storage struct {
+	sync.Mutex
+	notifier.Subscriptions
+	notifier  notifier.Notifier
+	publishMx sync.Mutex // keeps the order of published snapshots
+	prefix    string
+	all       bool
+	aliases   map[string]string
+	stop      chan bool
+}
+
+// New storage connector, for the prefix `APP` the key `service/listen`
+// is mapped to the variable APP_SERVICE_LISTEN. With empty prefix only
+// variables defined by Alias are used, other variables of the process
+// like PATH are not mapped into the config until MapAll is called.
+func New(prefix string) *Storage {
+	var s = &Storage{
+		prefix:  strings.ToUpper(prefix),
+		aliases: map[string]string{},
+	}
+	s.Subscriptions = s.notifier.Subscriptions()
+	s.refresh()
+	return s
+}
+
+// Alias defines the name of the variable for the key
+func (s *Storage) Alias(key, name string) *Storage {
+	s.Lock()
+	s.aliases[name] = key
+	s.Unlock()
+	s.refresh()
+	return s
+}
+
+// MapAll variables of the process into the config if the prefix is empty,
+// the variable SERVICE_LISTEN is mapped to the key `service/listen`
+func (s *Storage) MapAll() *Storage {
+	s.Lock()
+	s.all = true
+	s.Unlock()
+	s.refresh()
+	return s
+}
+
+// Load all current values synchronously
+func (s *Storage) Load(ctx context.Context) (map[string]interface{}, error) {
+	s.refresh()
+	return s.notifier.Values(), nil
+}
+
+// Discovery services is not supported
+func (s *Storage) Discovery() service.Discovery {
+	return nil
+}
+
+// Supervisor of auto refresh
+func (s *Storage) Supervisor(interval time.Duration) {
+	s.Stop()
+
+	s.Lock()
+	var stop = make(chan bool)
+	s.stop = stop
+	s.Unlock()
+
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.refresh()
+		case <-stop:
+			return
+		}
+	} // end for
+}
+
+// Stop supervisord
+func (s *Storage) Stop() {
+	s.Lock()
+	if nil != s.stop {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.Unlock()
+}
+
+// refresh values from the environment
+func (s *Storage) refresh() {
+	var data = map[string]string{}
+
+	s.publishMx.Lock()
+	defer s.publishMx.Unlock()
+
+	s.Lock()
+	for _, env := range os.Environ() {
+		var idx = strings.IndexByte(env, '=')
+		if idx < 1 {
+			continue
+		}
+		if key := s.key(env[:idx]); key != "" {
+			data[key] = env[idx+1:]
+		}
+	}
+	s.Unlock()
+
+	s.notifier.Update(data)
+}
+
+// key of config by the name of variable
+func (s *Storage) key(name string) string {
+	if key, ok := s.aliases[name]; ok {
+		return key
+	}
+
+	if s.prefix == "" {
+		if !s.all {
+			return ""
+		}
+	} else if strings.HasPrefix(name, s.prefix+"_") {
+		name = name[len(s.prefix)+1:]
+	} else {
+		return ""
+	}
+	return strings.Replace(strings.ToLower(name), "_", "/", -1)
+}
@@ -0,0 +1,56 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package env
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorage(t *testing.T) {
+	os.Setenv("REGTEST_SERVICE_LISTEN", ":8080")
+	os.Setenv("REGTEST_DB_MAX_CONN", "10")
+	defer os.Unsetenv("REGTEST_SERVICE_LISTEN")
+	defer os.Unsetenv("REGTEST_DB_MAX_CONN")
+
+	var (
+		st     = New("regtest").Alias("db/max_conn", "REGTEST_DB_MAX_CONN")
+		values = map[string]interface{}{}
+	)
+	st.Subscribe(func(key string, value interface{}) {
+		values[key] = value
+	})
+
+	assert.Equal(t, ":8080", values["service/listen"])
+	assert.Equal(t, "10", values["db/max_conn"])
+
+	os.Unsetenv("REGTEST_SERVICE_LISTEN")
+	data, err := st.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, data["service/listen"], "Removed variable")
+	assert.Nil(t, values["service/listen"], "Removed variable event")
+}
+
+func TestStorageWithoutPrefix(t *testing.T) {
+	os.Setenv("REGTEST_SERVICE_LISTEN", ":8080")
+	defer os.Unsetenv("REGTEST_SERVICE_LISTEN")
+
+	data, err := New("").Alias("service/listen", "REGTEST_SERVICE_LISTEN").Load(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"service/listen": ":8080"}, data, "Only aliases")
+}
+
+func TestStorageMapAll(t *testing.T) {
+	os.Setenv("REGTEST_SERVICE_LISTEN", ":8080")
+	defer os.Unsetenv("REGTEST_SERVICE_LISTEN")
+
+	data, err := New("").MapAll().Load(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, ":8080", data["regtest/service/listen"], "Variable without prefix")
+}
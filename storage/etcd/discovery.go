@@ -0,0 +1,281 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+
+	"github.com/geniusrabbit/registry/service"
+)
+
+const (
+	defaultServicePrefix = "registry/services/"
+	defaultServiceTTL    = time.Second * 10
+	defaultRetryDelay    = time.Second
+)
+
+// discovery of services registered by leases,
+// the service disappears when the lease of registration expires
+type discovery struct {
+	mx       sync.RWMutex
+	client   *clientv3.Client
+	prefix   string
+	ttl      time.Duration
+	leases   map[string]*registration
+	services map[string]*service.Service
+	watching bool
+	onError  func(err error)
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+type registration struct {
+	lease  clientv3.LeaseID
+	cancel context.CancelFunc
+}
+
+func newDiscovery(client *clientv3.Client, prefix string, ttl time.Duration, onError func(err error)) *discovery {
+	var ctx, cancel = context.WithCancel(context.Background())
+	return &discovery{
+		client:   client,
+		prefix:   prefix,
+		ttl:      ttl,
+		leases:   map[string]*registration{},
+		services: map[string]*service.Service{},
+		onError:  onError,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Register new service with the lease which is kept alive
+// until Unregister or closing of the storage. If the lease is lost
+// then the service is registered again with the new lease.
+func (d *discovery) Register(options service.Options) error {
+	data, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+
+	var ctx, cancel = context.WithCancel(d.ctx)
+	lease, alive, err := d.grant(ctx, options.ID, data)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	var reg = &registration{lease: lease, cancel: cancel}
+
+	d.mx.Lock()
+	if prev, ok := d.leases[options.ID]; ok {
+		prev.cancel()
+	}
+	d.leases[options.ID] = reg
+	d.mx.Unlock()
+
+	go d.keepAlive(ctx, reg, options.ID, data, alive)
+	return nil
+}
+
+// Unregister servece by ID
+func (d *discovery) Unregister(id string) error {
+	d.mx.Lock()
+	reg, ok := d.leases[id]
+	delete(d.leases, id)
+	var lease clientv3.LeaseID
+	if ok {
+		lease = reg.lease
+	}
+	d.mx.Unlock()
+
+	if ok {
+		reg.cancel()
+		_, err := d.client.Revoke(d.ctx, lease)
+		return err
+	}
+
+	_, err := d.client.Delete(d.ctx, d.prefix+id)
+	return err
+}
+
+// Lookup services by filter. Registered services are cached
+// and the cache is updated by the watch of the services prefix.
+func (d *discovery) Lookup(filter *service.Filter) (services []*service.Service, err error) {
+	if err = d.sync(); err != nil {
+		return nil, err
+	}
+
+	d.mx.RLock()
+	for _, srv := range d.services {
+		if srv.Test(filter) {
+			var s = *srv
+			services = append(services, &s)
+		}
+	}
+	d.mx.RUnlock()
+
+	service.List(services).Sort()
+	return services, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Internal methods
+///////////////////////////////////////////////////////////////////////////////
+
+// grant the new lease and put the service with it
+func (d *discovery) grant(ctx context.Context, id string, data []byte) (clientv3.LeaseID, <-chan *clientv3.LeaseKeepAliveResponse, error) {
+	lease, err := d.client.Grant(ctx, int64(d.ttl/time.Second))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if _, err = d.client.Put(ctx, d.prefix+id, string(data), clientv3.WithLease(lease.ID)); err != nil {
+		return 0, nil, err
+	}
+
+	alive, err := d.client.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return lease.ID, alive, nil
+}
+
+// keepAlive the registration until the context is done. The keep alive
+// channel is closed when the lease is lost, then the service is registered
+// again with the new lease, errors of the registration are reported.
+func (d *discovery) keepAlive(ctx context.Context, reg *registration, id string, data []byte, alive <-chan *clientv3.LeaseKeepAliveResponse) {
+	for {
+		for range alive {
+		}
+
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+
+			lease, next, err := d.grant(ctx, id, data)
+			if err == nil {
+				d.mx.Lock()
+				reg.lease = lease
+				d.mx.Unlock()
+				alive = next
+				break
+			}
+
+			if ctx.Err() == nil && nil != d.onError {
+				d.onError(err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(defaultRetryDelay):
+			}
+		}
+	}
+}
+
+// sync loads services and starts the watch if it's not active
+func (d *discovery) sync() error {
+	d.mx.RLock()
+	var watching = d.watching
+	d.mx.RUnlock()
+
+	if watching {
+		return nil
+	}
+
+	resp, err := d.client.Get(d.ctx, d.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	var services = make(map[string]*service.Service, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		if srv := d.decode(kv.Value); nil != srv {
+			services[d.id(string(kv.Key))] = srv
+		}
+	}
+
+	d.mx.Lock()
+	d.services = services
+	if !d.watching {
+		d.watching = true
+		go d.watch(resp.Header.Revision + 1)
+	}
+	d.mx.Unlock()
+	return nil
+}
+
+// watch changes of services, the cache is reloaded
+// by the next Lookup if the watch is broken
+func (d *discovery) watch(rev int64) {
+	defer func() {
+		d.mx.Lock()
+		d.watching = false
+		d.mx.Unlock()
+	}()
+
+	var wch = d.client.Watch(d.ctx, d.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev))
+	for resp := range wch {
+		if resp.Err() != nil {
+			return
+		}
+
+		d.mx.Lock()
+		for _, ev := range resp.Events {
+			var id = d.id(string(ev.Kv.Key))
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				if srv := d.decode(ev.Kv.Value); nil != srv {
+					d.services[id] = srv
+				}
+			case clientv3.EventTypeDelete:
+				delete(d.services, id)
+			}
+		}
+		d.mx.Unlock()
+	}
+}
+
+// close discovery and revoke all leases
+func (d *discovery) close() {
+	d.mx.Lock()
+	var leases = make([]clientv3.LeaseID, 0, len(d.leases))
+	for _, reg := range d.leases {
+		reg.cancel()
+		leases = append(leases, reg.lease)
+	}
+	d.leases = map[string]*registration{}
+	d.mx.Unlock()
+
+	for _, lease := range leases {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultDialTimeout)
+		d.client.Revoke(ctx, lease)
+		cancel()
+	}
+	d.cancel()
+}
+
+func (d *discovery) decode(data []byte) *service.Service {
+	var options service.Options
+	if err := json.Unmarshal(data, &options); err != nil {
+		return nil
+	}
+	var srv = options.Service()
+	srv.Status = service.StatusPassing
+	return srv
+}
+
+func (d *discovery) id(key string) string {
+	return strings.TrimPrefix(key, d.prefix)
+}
@@ -0,0 +1,244 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package etcd
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+
+	"github.com/geniusrabbit/registry/service"
+	"github.com/geniusrabbit/registry/storage/notifier"
+)
+
+const defaultDialTimeout = time.Second * 5
+
+// Storage accessor to etcd v3
+type Storage struct {
+	sync.Mutex
+	notifier.Subscriptions
+	notifier  notifier.Notifier
+	publishMx sync.Mutex // keeps the order of published snapshots
+	prefix    string
+	client    *clientv3.Client
+	ownClient bool
+	values    map[string]string
+	revision  int64
+	discovery *discovery
+	stop      chan bool
+}
+
+// New storage connector to the etcd cluster
+func New(prefix string, endpoints ...string) (*Storage, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: defaultDialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var s = NewWithClient(prefix, client)
+	s.ownClient = true
+	return s, nil
+}
+
+// NewWithClient storage connector with the custom client
+func NewWithClient(prefix string, client *clientv3.Client) *Storage {
+	var s = &Storage{
+		prefix: strings.Trim(prefix, "/"),
+		client: client,
+		values: map[string]string{},
+	}
+	s.Subscriptions = s.notifier.Subscriptions()
+	return s
+}
+
+// Load all current values synchronously
+func (s *Storage) Load(ctx context.Context) (map[string]interface{}, error) {
+	if _, err := s.reload(ctx); err != nil {
+		return nil, err
+	}
+	return s.notifier.Values(), nil
+}
+
+// Discovery services, services are registered under the key
+// `registry/services/<prefix>/` so storages with different prefixes
+// have separate lists of services. Keys of services are never
+// mapped into the config even if the prefix is empty.
+func (s *Storage) Discovery() service.Discovery {
+	s.Lock()
+	defer s.Unlock()
+
+	if nil == s.discovery {
+		s.discovery = newDiscovery(s.client, defaultServicePrefix+s.keyPrefix(), defaultServiceTTL, s.notifier.Error)
+	}
+	return s.discovery
+}
+
+// Supervisor of auto refresh. It watches changes of the prefix,
+// the interval is used as a delay before restart of failed watch.
+func (s *Storage) Supervisor(interval time.Duration) {
+	s.Stop()
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	s.Lock()
+	var stop = make(chan bool)
+	s.stop = stop
+	s.Unlock()
+
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for {
+		rev, err := s.reload(ctx)
+		if err == nil {
+			err = s.watch(ctx, rev+1)
+		}
+
+		if err != nil && ctx.Err() == nil {
+			s.notifier.Error(err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	} // end for
+}
+
+// Stop supervisord
+func (s *Storage) Stop() {
+	s.Lock()
+	if nil != s.stop {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.Unlock()
+}
+
+// Close storage, unregister services of the discovery
+// and close the client if it was created by the storage
+func (s *Storage) Close() error {
+	s.Stop()
+
+	s.Lock()
+	var d = s.discovery
+	s.Unlock()
+
+	if nil != d {
+		d.close()
+	}
+
+	if s.ownClient {
+		return s.client.Close()
+	}
+	return nil
+}
+
+// reload all values of the prefix and returns the revision of data,
+// data older than already published revision is skipped
+func (s *Storage) reload(ctx context.Context) (int64, error) {
+	resp, err := s.client.Get(ctx, s.keyPrefix(), clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	var values = make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		if key := string(kv.Key); s.isConfigKey(key) {
+			values[s.key(key)] = string(kv.Value)
+		}
+	}
+
+	s.publishMx.Lock()
+	defer s.publishMx.Unlock()
+
+	s.Lock()
+	if resp.Header.Revision < s.revision {
+		s.Unlock()
+		return resp.Header.Revision, nil
+	}
+	s.values = values
+	s.revision = resp.Header.Revision
+	s.Unlock()
+
+	s.notifier.Update(values)
+	return resp.Header.Revision, nil
+}
+
+// watch changes of the prefix from the revision until error or cancel
+func (s *Storage) watch(ctx context.Context, rev int64) error {
+	var wch = s.client.Watch(ctx, s.keyPrefix(), clientv3.WithPrefix(), clientv3.WithRev(rev))
+
+	for resp := range wch {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+
+		s.publishMx.Lock()
+		s.Lock()
+		var (
+			values  = make(map[string]string, len(s.values))
+			changed bool
+		)
+		for key, val := range s.values {
+			values[key] = val
+		}
+		for _, ev := range resp.Events {
+			// Events already applied by the reload are skipped
+			if ev.Kv.ModRevision <= s.revision || !s.isConfigKey(string(ev.Kv.Key)) {
+				continue
+			}
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				values[s.key(string(ev.Kv.Key))] = string(ev.Kv.Value)
+			case clientv3.EventTypeDelete:
+				delete(values, s.key(string(ev.Kv.Key)))
+			}
+			changed = true
+		}
+		if changed {
+			s.values = values
+		}
+		if resp.Header.Revision > s.revision {
+			s.revision = resp.Header.Revision
+		}
+		s.Unlock()
+
+		if changed {
+			s.notifier.Update(values)
+		}
+		s.publishMx.Unlock()
+	}
+	return ctx.Err()
+}
+
+// keyPrefix of all config keys in etcd
+func (s *Storage) keyPrefix() string {
+	if s.prefix != "" {
+		return s.prefix + "/"
+	}
+	return ""
+}
+
+// isConfigKey returns false for keys of the discovery,
+// they are under the config prefix if it's empty
+func (s *Storage) isConfigKey(k string) bool {
+	return !strings.HasPrefix(k, defaultServicePrefix)
+}
+
+// key of config relative to the prefix
+func (s *Storage) key(k string) string {
+	return strings.TrimPrefix(k, s.keyPrefix())
+}
@@ -0,0 +1,182 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package etcd
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/geniusrabbit/registry/service"
+)
+
+func TestStorage(t *testing.T) {
+	var client, stop = startEtcd(t)
+	defer stop()
+
+	var ctx = context.Background()
+	client.Put(ctx, "app/service/name", "test")
+	client.Put(ctx, "other/key", "skip")
+
+	var (
+		st      = NewWithClient("app", client)
+		updates = make(chan map[string]interface{}, 10)
+	)
+	defer st.Close()
+
+	values, err := st.Load(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{"service/name": "test"}, values)
+	}
+
+	st.SubscribeBatch(func(values map[string]interface{}) {
+		updates <- values
+	})
+	<-updates // current values
+
+	go st.Supervisor(time.Second)
+
+	client.Put(ctx, "app/service/port", "8080")
+	assert.Equal(t, map[string]interface{}{"service/port": "8080"}, waitUpdate(t, updates))
+
+	client.Delete(ctx, "app/service/name")
+	assert.Equal(t, map[string]interface{}{"service/name": nil}, waitUpdate(t, updates))
+}
+
+func TestStorageWithoutPrefix(t *testing.T) {
+	var client, stop = startEtcd(t)
+	defer stop()
+
+	var ctx = context.Background()
+	client.Put(ctx, "service/name", "test")
+
+	var st = NewWithClient("", client)
+	defer st.Close()
+
+	assert.NoError(t, st.Discovery().Register(service.Options{ID: "api-1", Name: "api", Address: "127.0.0.1:8080"}))
+
+	values, err := st.Load(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{"service/name": "test"}, values, "Services are not config keys")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	var client, stop = startEtcd(t)
+	defer stop()
+
+	var st = NewWithClient("app", client)
+	defer st.Close()
+
+	var discovery = st.Discovery()
+	assert.NoError(t, discovery.Register(service.Options{ID: "api-1", Name: "api", Address: "127.0.0.1:8080"}))
+	assert.NoError(t, discovery.Register(service.Options{ID: "db-1", Name: "db", Address: "127.0.0.1:5432"}))
+
+	services, err := discovery.Lookup(&service.Filter{Service: "api"})
+	if assert.NoError(t, err) && assert.Len(t, services, 1) {
+		assert.Equal(t, "api-1", services[0].ID)
+		assert.Equal(t, service.StatusPassing, services[0].Status)
+	}
+
+	// The service is registered again after the lease is lost
+	resp, err := client.Get(context.Background(), "registry/services/app/db-1")
+	if assert.NoError(t, err) && assert.Len(t, resp.Kvs, 1) {
+		_, err = client.Revoke(context.Background(), clientv3.LeaseID(resp.Kvs[0].Lease))
+		assert.NoError(t, err)
+	}
+
+	var registered bool
+	for deadline := time.Now().Add(time.Second * 5); !registered && time.Now().Before(deadline); time.Sleep(time.Millisecond * 100) {
+		services, err = discovery.Lookup(&service.Filter{Service: "db"})
+		registered = nil == err && len(services) == 1
+	}
+	assert.True(t, registered, "Service is not registered after the lease loss")
+
+	assert.NoError(t, discovery.Unregister("api-1"))
+	time.Sleep(time.Millisecond * 100)
+
+	services, err = discovery.Lookup(&service.Filter{Service: "api"})
+	assert.NoError(t, err)
+	assert.Len(t, services, 0)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Helpers
+///////////////////////////////////////////////////////////////////////////////
+
+func startEtcd(t *testing.T) (*clientv3.Client, func()) {
+	dir, err := ioutil.TempDir("", "registry-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		cfg       = embed.NewConfig()
+		peerURL   = freeURL(t)
+		clientURL = freeURL(t)
+	)
+	cfg.Dir = dir
+	cfg.LPUrls, cfg.APUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.LCUrls, cfg.ACUrls = []url.URL{clientURL}, []url.URL{clientURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Embedded etcd is not available: %s", err)
+	}
+
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(time.Second * 10):
+		server.Close()
+		os.RemoveAll(dir)
+		t.Fatal("Embedded etcd start timeout")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{clientURL.String()},
+		DialTimeout: defaultDialTimeout,
+	})
+	if err != nil {
+		server.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return client, func() {
+		client.Close()
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func waitUpdate(t *testing.T, updates chan map[string]interface{}) map[string]interface{} {
+	select {
+	case values := <-updates:
+		return values
+	case <-time.After(time.Second * 5):
+		t.Fatal("Update timeout")
+	}
+	return nil
+}
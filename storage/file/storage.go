@@ -0,0 +1,286 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fsnotify/fsnotify"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/geniusrabbit/registry/service"
+	"github.com/geniusrabbit/registry/storage/notifier"
+)
+
+// File formats
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// Delay of the reload after the last change of the file,
+// editors write files by several operations
+const reloadDelay = time.Millisecond * 100
+
+// Errors set
+var (
+	ErrUnsupportedFormat = errors.New("Unsupported file format")
+	ErrEmptyFile         = errors.New("Config file is empty")
+)
+
+// Storage of config values from JSON, YAML or TOML file.
+// Nested objects are flattened into keys separated by `/`,
+// items of arrays have indexes as the last element of the key.
+type Storage struct {
+	sync.Mutex
+	notifier.Subscriptions
+	notifier  notifier.Notifier
+	publishMx sync.Mutex // keeps the order of published snapshots
+	filename  string
+	format    string
+	stop      chan bool
+}
+
+// New storage connector, the format of the file is detected
+// by the extension: .json, .yaml, .yml or .toml
+func New(filename string) (*Storage, error) {
+	var format string
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		format = FormatJSON
+	case ".yaml", ".yml":
+		format = FormatYAML
+	case ".toml":
+		format = FormatTOML
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	return NewWithFormat(filename, format)
+}
+
+// NewWithFormat storage connector for the file of the format
+func NewWithFormat(filename, format string) (*Storage, error) {
+	switch format {
+	case FormatJSON, FormatYAML, FormatTOML:
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+
+	var s = &Storage{filename: filename, format: format}
+	s.Subscriptions = s.notifier.Subscriptions()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load all current values synchronously
+func (s *Storage) Load(ctx context.Context) (map[string]interface{}, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	return s.notifier.Values(), nil
+}
+
+// Discovery services is not supported
+func (s *Storage) Discovery() service.Discovery {
+	return nil
+}
+
+// Supervisor of auto refresh. It watches the directory of the file
+// to catch the atomic replacement of the file or of the symlink
+// like in ConfigMap mounts, the interval is used for periodic reload.
+// Changes of the file are reloaded after the short delay to skip
+// intermediate states of the file.
+func (s *Storage) Supervisor(interval time.Duration) {
+	s.Stop()
+
+	s.Lock()
+	var stop = make(chan bool)
+	s.stop = stop
+	s.Unlock()
+
+	var (
+		ticker  = time.NewTicker(interval)
+		delay   = time.NewTimer(reloadDelay)
+		target  = s.target()
+		events  <-chan fsnotify.Event
+		errs    <-chan error
+		watcher *fsnotify.Watcher
+		err     error
+	)
+	defer ticker.Stop()
+	defer delay.Stop()
+
+	if !delay.Stop() {
+		<-delay.C
+	}
+
+	if watcher, err = fsnotify.NewWatcher(); err != nil {
+		s.notifier.Error(err)
+	} else {
+		defer watcher.Close()
+		if err = watcher.Add(filepath.Dir(s.filename)); err != nil {
+			s.notifier.Error(err)
+		} else {
+			events, errs = watcher.Events, watcher.Errors
+		}
+	}
+
+	for {
+		select {
+		case event := <-events:
+			if s.isFileEvent(event, &target) {
+				if !delay.Stop() {
+					select {
+					case <-delay.C:
+					default:
+					}
+				}
+				delay.Reset(reloadDelay)
+			}
+		case <-delay.C:
+			s.reload()
+		case err := <-errs:
+			s.notifier.Error(err)
+		case <-ticker.C:
+			s.reload()
+		case <-stop:
+			return
+		}
+	} // end for
+}
+
+// Stop supervisord
+func (s *Storage) Stop() {
+	s.Lock()
+	if nil != s.stop {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.Unlock()
+}
+
+// reload file and report the error
+func (s *Storage) reload() {
+	if err := s.refresh(); err != nil {
+		s.notifier.Error(err)
+	}
+}
+
+// refresh values from the file
+func (s *Storage) refresh() error {
+	s.publishMx.Lock()
+	defer s.publishMx.Unlock()
+
+	data, err := ioutil.ReadFile(s.filename)
+	if err != nil {
+		return err
+	}
+
+	var values interface{}
+	switch {
+	case len(bytes.TrimSpace(data)) == 0:
+		// Empty file has no values in any format
+	case s.format == FormatJSON:
+		err = json.Unmarshal(data, &values)
+	case s.format == FormatYAML:
+		err = yaml.Unmarshal(data, &values)
+	case s.format == FormatTOML:
+		var tvalues map[string]interface{}
+		err = toml.Unmarshal(data, &tvalues)
+		values = tvalues
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var flat = map[string]string{}
+	flatten(flat, "", values)
+
+	// Empty file is usually the intermediate state of the file saving,
+	// it must not remove all values
+	if len(flat) == 0 && len(s.notifier.Values()) > 0 {
+		return ErrEmptyFile
+	}
+
+	s.notifier.Update(flat)
+	return nil
+}
+
+// isFileEvent returns true if the event is about the file or the target
+// of the file symlink was changed, other files of the directory are skipped
+func (s *Storage) isFileEvent(event fsnotify.Event, target *string) bool {
+	if filepath.Clean(event.Name) == filepath.Clean(s.filename) {
+		return true
+	}
+	if path := s.target(); path != *target {
+		*target = path
+		return true
+	}
+	return false
+}
+
+// target of the file if it's a symlink
+func (s *Storage) target() string {
+	path, _ := filepath.EvalSymlinks(s.filename)
+	return path
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Helpers
+///////////////////////////////////////////////////////////////////////////////
+
+// flatten nested values into the map with `/` separated keys
+func flatten(flat map[string]string, prefix string, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+	case map[string]interface{}:
+		for key, val := range v {
+			flatten(flat, joinKey(prefix, key), val)
+		}
+	case map[interface{}]interface{}:
+		for key, val := range v {
+			flatten(flat, joinKey(prefix, fmt.Sprint(key)), val)
+		}
+	case []map[string]interface{}:
+		for i, val := range v {
+			flatten(flat, joinKey(prefix, strconv.Itoa(i)), val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			flatten(flat, joinKey(prefix, strconv.Itoa(i)), val)
+		}
+	case string:
+		flat[prefix] = v
+	case float64:
+		flat[prefix] = strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		flat[prefix] = v.Format(time.RFC3339Nano)
+	default:
+		flat[prefix] = fmt.Sprint(v)
+	}
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "/" + key
+}
@@ -0,0 +1,158 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var filename = filepath.Join(dir, "config.json")
+	ioutil.WriteFile(filename, []byte(`{
+		"service": {"name": "test", "port": 8080, "debug": true},
+		"hosts": ["10.0.0.1", "10.0.0.2"]
+	}`), 0644)
+
+	st, err := New(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var values = map[string]interface{}{}
+	st.Subscribe(func(key string, value interface{}) {
+		values[key] = value
+	})
+
+	assert.Equal(t, map[string]interface{}{
+		"service/name":  "test",
+		"service/port":  "8080",
+		"service/debug": "true",
+		"hosts/0":       "10.0.0.1",
+		"hosts/1":       "10.0.0.2",
+	}, values)
+
+	ioutil.WriteFile(filename, []byte(`{"service": {"name": "test2"}}`), 0644)
+	data, err := st.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"service/name": "test2"}, data)
+	assert.Equal(t, "test2", values["service/name"])
+	assert.Nil(t, values["service/port"], "Removed key")
+
+	_, err = New(filepath.Join(dir, "config.ini"))
+	assert.Equal(t, ErrUnsupportedFormat, err)
+}
+
+func TestStorageConcurrentLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var filename = filepath.Join(dir, "config.json")
+	ioutil.WriteFile(filename, []byte(`{"service": {"name": "test"}}`), 0644)
+
+	st, err := New(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var (
+		mx    sync.Mutex
+		name  interface{}
+		wg    sync.WaitGroup
+		names = []string{`{"service": {"name": "test1"}}`, `{"service": {"name": "test2"}}`}
+	)
+	st.Subscribe(func(key string, value interface{}) {
+		mx.Lock()
+		name = value
+		mx.Unlock()
+	})
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if i == 0 {
+					ioutil.WriteFile(filename, []byte(names[j%2]), 0644)
+				}
+				st.Load(context.Background())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	data, err := st.Load(context.Background())
+	assert.NoError(t, err)
+	mx.Lock()
+	assert.Equal(t, data["service/name"], name, "Last published value")
+	mx.Unlock()
+}
+
+func TestStorageWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var filename = filepath.Join(dir, "config.json")
+	ioutil.WriteFile(filename, []byte(`{"service": {"name": "test"}}`), 0644)
+
+	st, err := New(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var (
+		updates = make(chan map[string]interface{}, 10)
+		errs    = make(chan error, 10)
+	)
+	st.OnError(func(err error) { errs <- err })
+	st.SubscribeBatch(func(values map[string]interface{}) { updates <- values })
+	<-updates // Initial values
+
+	go st.Supervisor(time.Hour)
+	defer st.Stop()
+	time.Sleep(time.Millisecond * 50)
+
+	// Other files of the directory are skipped
+	ioutil.WriteFile(filepath.Join(dir, "other.json"), []byte(`{"service": {"name": "other"}}`), 0644)
+
+	// Empty file must not remove values
+	ioutil.WriteFile(filename, nil, 0644)
+	select {
+	case err := <-errs:
+		assert.Equal(t, ErrEmptyFile, err)
+	case values := <-updates:
+		t.Errorf("Unexpected update: %v", values)
+	case <-time.After(time.Second * 2):
+		t.Error("Empty file error is not reported")
+	}
+
+	ioutil.WriteFile(filename, []byte(`{"service": {"name": "test2"}}`), 0644)
+	select {
+	case values := <-updates:
+		assert.Equal(t, map[string]interface{}{"service/name": "test2"}, values)
+	case <-time.After(time.Second * 2):
+		t.Error("Update of the file is not delivered")
+	}
+}
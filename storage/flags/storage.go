@@ -0,0 +1,97 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package flags
+
+import (
+	"context"
+	"flag"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geniusrabbit/registry/service"
+	"github.com/geniusrabbit/registry/storage/notifier"
+)
+
+// Storage of config values from command line flags.
+// The flag `-service.listen` is mapped to the key `service/listen`.
+// Only flags which were set explicitly are used, so default values
+// of flags don't override values of other storages.
+type Storage struct {
+	sync.Mutex
+	notifier.Subscriptions
+	notifier  notifier.Notifier
+	publishMx sync.Mutex // keeps the order of published snapshots
+	flags     *flag.FlagSet
+	aliases   map[string]string
+}
+
+// New storage connector for the parsed flag set,
+// if flags is nil then flag.CommandLine is used
+func New(flags *flag.FlagSet) *Storage {
+	if nil == flags {
+		flags = flag.CommandLine
+	}
+	var s = &Storage{
+		flags:   flags,
+		aliases: map[string]string{},
+	}
+	s.Subscriptions = s.notifier.Subscriptions()
+	s.refresh()
+	return s
+}
+
+// Alias defines the name of the flag for the key
+func (s *Storage) Alias(key, name string) *Storage {
+	s.Lock()
+	s.aliases[name] = key
+	s.Unlock()
+	s.refresh()
+	return s
+}
+
+// Load all current values synchronously
+func (s *Storage) Load(ctx context.Context) (map[string]interface{}, error) {
+	s.refresh()
+	return s.notifier.Values(), nil
+}
+
+// Discovery services is not supported
+func (s *Storage) Discovery() service.Discovery {
+	return nil
+}
+
+// Supervisor of auto refresh, flags are not changed after parsing
+// so it only refreshes values once
+func (s *Storage) Supervisor(interval time.Duration) {
+	s.refresh()
+}
+
+// refresh values from the flag set
+func (s *Storage) refresh() {
+	var data = map[string]string{}
+
+	s.publishMx.Lock()
+	defer s.publishMx.Unlock()
+
+	s.Lock()
+	if s.flags.Parsed() {
+		s.flags.Visit(func(f *flag.Flag) {
+			data[s.key(f.Name)] = f.Value.String()
+		})
+	}
+	s.Unlock()
+
+	s.notifier.Update(data)
+}
+
+// key of config by the name of flag
+func (s *Storage) key(name string) string {
+	if key, ok := s.aliases[name]; ok {
+		return key
+	}
+	return strings.Replace(name, ".", "/", -1)
+}
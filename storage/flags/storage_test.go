@@ -0,0 +1,73 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package flags
+
+import (
+	"context"
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/geniusrabbit/registry"
+	"github.com/geniusrabbit/registry/storage/memory"
+)
+
+func newFlagSet(args ...string) *flag.FlagSet {
+	var fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("service.listen", ":80", "listen address")
+	fs.String("service.name", "default", "service name")
+	fs.Int("max-conn", 10, "max connections")
+	fs.Parse(args)
+	return fs
+}
+
+func TestStorage(t *testing.T) {
+	var (
+		st     = New(newFlagSet("-service.listen=:8080", "-max-conn", "20")).Alias("db/max_conn", "max-conn")
+		values = map[string]interface{}{}
+	)
+	st.Subscribe(func(key string, value interface{}) {
+		values[key] = value
+	})
+
+	assert.Equal(t, map[string]interface{}{
+		"service/listen": ":8080",
+		"db/max_conn":    "20",
+	}, values, "Only explicitly set flags")
+
+	data, err := st.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, values, data)
+}
+
+func TestStorageNotParsed(t *testing.T) {
+	var fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("service.listen", ":80", "listen address")
+
+	data, err := New(fs).Load(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, data, 0)
+}
+
+func TestStoragePriority(t *testing.T) {
+	var (
+		heap registry.BindHeap
+		conf = &struct {
+			Listen string `store:"service/listen"`
+			Name   string `store:"service/name"`
+		}{}
+	)
+	heap.RegisterStore(New(newFlagSet("-service.listen=:8080")), 10)
+	heap.RegisterStore(memory.New(map[string]string{
+		"service/listen": ":9090",
+		"service/name":   "api",
+	}))
+
+	assert.NoError(t, heap.BindAndLoad(context.Background(), conf), "BindAndLoad")
+	assert.Equal(t, ":8080", conf.Listen, "Flag overrides other storages")
+	assert.Equal(t, "api", conf.Name, "Default value of the flag doesn't override other storages")
+}
@@ -0,0 +1,80 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package memory
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/geniusrabbit/registry/service"
+)
+
+// Errors set
+var (
+	ErrServiceNotFound = errors.New("Service not found")
+)
+
+// Discovery of services in memory. Registered services have
+// passing status, use SetStatus to simulate health changes.
+type Discovery struct {
+	sync.RWMutex
+	services map[string]*service.Service
+}
+
+// NewDiscovery in memory
+func NewDiscovery() *Discovery {
+	return &Discovery{services: map[string]*service.Service{}}
+}
+
+// Register new service
+func (d *Discovery) Register(options service.Options) error {
+	var srv = options.Service()
+	srv.Status = service.StatusPassing
+
+	d.Lock()
+	d.services[srv.ID] = srv
+	d.Unlock()
+	return nil
+}
+
+// Unregister servece by ID
+func (d *Discovery) Unregister(id string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.services[id]; !ok {
+		return ErrServiceNotFound
+	}
+	delete(d.services, id)
+	return nil
+}
+
+// Lookup services by filter, returns copies of registered services
+func (d *Discovery) Lookup(filter *service.Filter) (services []*service.Service, err error) {
+	d.RLock()
+	for _, srv := range d.services {
+		if srv.Test(filter) {
+			var s = *srv
+			services = append(services, &s)
+		}
+	}
+	d.RUnlock()
+
+	service.List(services).Sort()
+	return services, nil
+}
+
+// SetStatus of the service to simulate health changes
+func (d *Discovery) SetStatus(id string, status int8) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if srv, ok := d.services[id]; ok {
+		srv.Status = status
+		return nil
+	}
+	return ErrServiceNotFound
+}
@@ -0,0 +1,142 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/geniusrabbit/registry/service"
+	"github.com/geniusrabbit/registry/storage/notifier"
+)
+
+// Storage of config values in memory, all changes are sent
+// to subscribers immediately. Useful for tests.
+type Storage struct {
+	sync.Mutex
+	notifier.Subscriptions
+	notifier  notifier.Notifier
+	publishMx sync.Mutex // keeps the order of published snapshots
+	values    map[string]string
+	indexes   map[string]uint64 // modify indexes of keys
+	index     uint64            // last modify index
+	discovery *Discovery
+}
+
+// New storage connector with the initial values
+func New(values map[string]string) *Storage {
+	var s = &Storage{
+		values:    map[string]string{},
+		indexes:   map[string]uint64{},
+		discovery: NewDiscovery(),
+	}
+	s.Subscriptions = s.notifier.Subscriptions()
+	for key, val := range values {
+		s.set(key, val)
+	}
+	s.notifier.Update(s.Snapshot())
+	return s
+}
+
+// Get value of the key and the modify index of the value,
+// the index is zero if the key is not exists
+func (s *Storage) Get(key string) (string, uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.values[key], s.indexes[key], nil
+}
+
+// Set value for key
+func (s *Storage) Set(key, value string) error {
+	s.Update(map[string]interface{}{key: value})
+	return nil
+}
+
+// Delete value by key
+func (s *Storage) Delete(key string) error {
+	s.Update(map[string]interface{}{key: nil})
+	return nil
+}
+
+// CompareAndSwap sets value of the key only if the modify index
+// of the key was not changed, zero index means that the key must not exist
+func (s *Storage) CompareAndSwap(key, value string, index uint64) (bool, error) {
+	s.publishMx.Lock()
+	defer s.publishMx.Unlock()
+
+	s.Lock()
+	if s.indexes[key] != index {
+		s.Unlock()
+		return false, nil
+	}
+	s.set(key, value)
+	var data = s.snapshot()
+	s.Unlock()
+
+	s.notifier.Update(data)
+	return true, nil
+}
+
+// Update values as one batch, nil value deletes the key
+func (s *Storage) Update(values map[string]interface{}) {
+	s.publishMx.Lock()
+	defer s.publishMx.Unlock()
+
+	s.Lock()
+	for key, val := range values {
+		switch v := val.(type) {
+		case nil:
+			delete(s.values, key)
+			delete(s.indexes, key)
+		case string:
+			s.set(key, v)
+		default:
+			s.set(key, fmt.Sprint(v))
+		}
+	}
+	var data = s.snapshot()
+	s.Unlock()
+
+	s.notifier.Update(data)
+}
+
+// Snapshot returns the copy of all values
+func (s *Storage) Snapshot() map[string]string {
+	s.Lock()
+	defer s.Unlock()
+	return s.snapshot()
+}
+
+// Load all current values synchronously
+func (s *Storage) Load(ctx context.Context) (map[string]interface{}, error) {
+	return s.notifier.Values(), nil
+}
+
+// Discovery services
+func (s *Storage) Discovery() service.Discovery {
+	return s.discovery
+}
+
+// Supervisor of auto refresh, changes are sent immediately
+// so there is nothing to refresh
+func (s *Storage) Supervisor(interval time.Duration) {}
+
+// set value of the key with the next modify index
+func (s *Storage) set(key, value string) {
+	s.index++
+	s.values[key] = value
+	s.indexes[key] = s.index
+}
+
+func (s *Storage) snapshot() map[string]string {
+	var data = make(map[string]string, len(s.values))
+	for key, val := range s.values {
+		data[key] = val
+	}
+	return data
+}
@@ -0,0 +1,122 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package memory
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/geniusrabbit/registry"
+	"github.com/geniusrabbit/registry/service"
+)
+
+var _ registry.WritableStorage = (*Storage)(nil)
+
+func TestStorage(t *testing.T) {
+	var (
+		st      = New(map[string]string{"service/name": "test"})
+		values  = map[string]interface{}{}
+		batches []map[string]interface{}
+	)
+	st.Subscribe(func(key string, value interface{}) {
+		values[key] = value
+	})
+	st.SubscribeBatch(func(values map[string]interface{}) {
+		batches = append(batches, values)
+	})
+	assert.Equal(t, "test", values["service/name"])
+
+	st.Set("service/port", "8080")
+	st.Delete("service/name")
+	assert.Equal(t, map[string]string{"service/port": "8080"}, st.Snapshot())
+	assert.Equal(t, "8080", values["service/port"])
+	assert.Nil(t, values["service/name"], "Deleted key")
+
+	st.Update(map[string]interface{}{"db/host": "db.local", "db/port": 5432})
+	assert.Equal(t, map[string]interface{}{"db/host": "db.local", "db/port": "5432"}, batches[len(batches)-1])
+}
+
+func TestStorageCompareAndSwap(t *testing.T) {
+	var st = New(map[string]string{"service/name": "test"})
+
+	value, index, err := st.Get("service/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "test", value)
+	assert.NotEqual(t, uint64(0), index)
+
+	ok, err := st.CompareAndSwap("service/name", "changed", index)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, _ = st.CompareAndSwap("service/name", "lost", index)
+	assert.False(t, ok, "Modify index is changed")
+	assert.Equal(t, "changed", st.Snapshot()["service/name"])
+
+	ok, _ = st.CompareAndSwap("service/port", "8080", 0)
+	assert.True(t, ok, "New key")
+	ok, _ = st.CompareAndSwap("service/port", "9090", 0)
+	assert.False(t, ok, "Key already exists")
+
+	assert.NoError(t, st.Delete("service/port"))
+	_, index, _ = st.Get("service/port")
+	assert.Equal(t, uint64(0), index)
+}
+
+func TestStorageConcurrentSet(t *testing.T) {
+	var (
+		wg     sync.WaitGroup
+		mx     sync.Mutex
+		st     = New(nil)
+		values = map[string]interface{}{}
+	)
+	st.Subscribe(func(key string, value interface{}) {
+		mx.Lock()
+		values[key] = value
+		mx.Unlock()
+	})
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st.Set(fmt.Sprintf("key/%d", i), "value")
+		}(i)
+	}
+	wg.Wait()
+
+	mx.Lock()
+	defer mx.Unlock()
+	for i := 0; i < 50; i++ {
+		assert.Equal(t, "value", values[fmt.Sprintf("key/%d", i)], "Lost update")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	var d = NewDiscovery()
+	d.Register(service.Options{ID: "api-1", Name: "api", Address: "10.0.0.1:8080", Tags: []string{"DC=dc1"}})
+	d.Register(service.Options{ID: "api-2", Name: "api", Address: "10.0.0.2:8080", Tags: []string{"DC=dc2"}})
+	d.Register(service.Options{ID: "db-1", Name: "db", Address: "10.0.0.3:5432", Tags: []string{"DC=dc1"}})
+
+	services, _ := d.Lookup(&service.Filter{Service: "api"})
+	assert.Len(t, services, 2)
+
+	services, _ = d.Lookup(&service.Filter{Datacenter: "dc1"})
+	assert.Len(t, services, 2)
+
+	assert.NoError(t, d.SetStatus("api-1", service.StatusCritical))
+	services, _ = d.Lookup(&service.Filter{Service: "api", Status: service.StatusPassing})
+	if assert.Len(t, services, 1) {
+		assert.Equal(t, "api-2", services[0].ID)
+	}
+
+	assert.NoError(t, d.Unregister("api-2"))
+	assert.Equal(t, ErrServiceNotFound, d.Unregister("api-2"))
+	services, _ = d.Lookup(nil)
+	assert.Len(t, services, 2)
+}
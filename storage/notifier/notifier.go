@@ -0,0 +1,228 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package notifier
+
+import "sync"
+
+// Notifier keeps current values of the storage and sends
+// only changed keys to subscribers. It implements subscription
+// methods of the registry.Storage and can be embedded into storages.
+// Values are kept as they are in the storage, so secret values
+// should be stored encrypted and decrypted by the registry.Decrypter.
+type Notifier struct {
+	mx          sync.Mutex
+	publishMx   sync.Mutex // keeps the order of the replay and published updates
+	seq         uint64
+	values      map[string]string
+	subscribers []subscriber
+	batches     []batchSubscriber
+	errors      []func(err error)
+}
+
+type subscriber struct {
+	id uint64
+	f  func(key string, value interface{})
+}
+
+type batchSubscriber struct {
+	id uint64
+	f  func(values map[string]interface{})
+}
+
+// Subscriptions exposes only subscription methods of the notifier,
+// storages embed it to implement subscription interfaces of the registry
+// without the access to the publishing methods
+type Subscriptions struct {
+	notifier *Notifier
+}
+
+// Subscriptions of the notifier
+func (n *Notifier) Subscriptions() Subscriptions {
+	return Subscriptions{notifier: n}
+}
+
+// Subscribe config key updater
+func (s Subscriptions) Subscribe(f func(key string, value interface{})) {
+	s.notifier.Subscribe(f)
+}
+
+// SubscribeBatch config changes updater, all changes
+// of one refresh cycle are sent together
+func (s Subscriptions) SubscribeBatch(f func(values map[string]interface{})) {
+	s.notifier.SubscribeBatch(f)
+}
+
+// SubscribeCancelable config key updater,
+// the returned function removes the subscription
+func (s Subscriptions) SubscribeCancelable(f func(key string, value interface{})) (cancel func()) {
+	return s.notifier.SubscribeCancelable(f)
+}
+
+// SubscribeBatchCancelable config changes updater,
+// the returned function removes the subscription
+func (s Subscriptions) SubscribeBatchCancelable(f func(values map[string]interface{})) (cancel func()) {
+	return s.notifier.SubscribeBatchCancelable(f)
+}
+
+// OnError registers the handler of refresh errors
+func (s Subscriptions) OnError(f func(err error)) {
+	s.notifier.OnError(f)
+}
+
+// Subscribe config key updater
+func (n *Notifier) Subscribe(f func(key string, value interface{})) {
+	n.SubscribeCancelable(f)
+}
+
+// SubscribeCancelable config key updater,
+// the returned function removes the subscription.
+// Known values are sent to the new subscriber before any next update,
+// so handlers must not subscribe to the same notifier.
+func (n *Notifier) SubscribeCancelable(f func(key string, value interface{})) (cancel func()) {
+	n.publishMx.Lock()
+	defer n.publishMx.Unlock()
+
+	n.mx.Lock()
+	n.seq++
+	var (
+		id     = n.seq
+		values = n.values
+	)
+	n.subscribers = append(n.subscribers, subscriber{id: id, f: f})
+	n.mx.Unlock()
+
+	// Send already known values to the new subscriber
+	for key, val := range values {
+		f(key, val)
+	}
+
+	return func() {
+		n.mx.Lock()
+		defer n.mx.Unlock()
+
+		var subscribers = make([]subscriber, 0, len(n.subscribers))
+		for _, sub := range n.subscribers {
+			if sub.id != id {
+				subscribers = append(subscribers, sub)
+			}
+		}
+		n.subscribers = subscribers
+	}
+}
+
+// SubscribeBatch config changes updater, all changes
+// of one refresh cycle are sent together
+func (n *Notifier) SubscribeBatch(f func(values map[string]interface{})) {
+	n.SubscribeBatchCancelable(f)
+}
+
+// SubscribeBatchCancelable config changes updater,
+// the returned function removes the subscription.
+// Known values are sent to the new subscriber before any next update.
+func (n *Notifier) SubscribeBatchCancelable(f func(values map[string]interface{})) (cancel func()) {
+	n.publishMx.Lock()
+	defer n.publishMx.Unlock()
+
+	n.mx.Lock()
+	n.seq++
+	var (
+		id     = n.seq
+		values = n.copyValues()
+	)
+	n.batches = append(n.batches, batchSubscriber{id: id, f: f})
+	n.mx.Unlock()
+
+	// Send already known values to the new subscriber
+	if len(values) > 0 {
+		f(values)
+	}
+
+	return func() {
+		n.mx.Lock()
+		defer n.mx.Unlock()
+
+		var batches = make([]batchSubscriber, 0, len(n.batches))
+		for _, sub := range n.batches {
+			if sub.id != id {
+				batches = append(batches, sub)
+			}
+		}
+		n.batches = batches
+	}
+}
+
+// OnError registers the handler of refresh errors
+func (n *Notifier) OnError(f func(err error)) {
+	n.mx.Lock()
+	n.errors = append(n.errors, f)
+	n.mx.Unlock()
+}
+
+// Values returns the copy of current values
+func (n *Notifier) Values() map[string]interface{} {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	return n.copyValues()
+}
+
+func (n *Notifier) copyValues() map[string]interface{} {
+	var values = make(map[string]interface{}, len(n.values))
+	for key, val := range n.values {
+		values[key] = val
+	}
+	return values
+}
+
+// Update current values and send only changed keys to subscribers,
+// removed keys are sent with nil value
+func (n *Notifier) Update(data map[string]string) {
+	n.publishMx.Lock()
+	defer n.publishMx.Unlock()
+
+	n.mx.Lock()
+	var changed = make(map[string]interface{}, len(data))
+	for key, val := range data {
+		if old, ok := n.values[key]; !ok || old != val {
+			changed[key] = val
+		}
+	}
+	for key := range n.values {
+		if _, ok := data[key]; !ok {
+			changed[key] = nil
+		}
+	}
+	n.values = data
+	var (
+		subscribers = n.subscribers
+		batches     = n.batches
+	)
+	n.mx.Unlock()
+
+	if len(changed) < 1 {
+		return
+	}
+
+	for _, sub := range subscribers {
+		for key, val := range changed {
+			sub.f(key, val)
+		}
+	}
+
+	for _, sub := range batches {
+		sub.f(changed)
+	}
+}
+
+// Error sends the error to all handlers
+func (n *Notifier) Error(err error) {
+	n.mx.Lock()
+	var handlers = n.errors
+	n.mx.Unlock()
+
+	for _, h := range handlers {
+		h(err)
+	}
+}
@@ -0,0 +1,323 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package registry
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const consistentHashReplicas = 100
+
+// StrategyItem is the upstream item which is chosen by the strategy
+type StrategyItem interface {
+	// Host name with port
+	Host() string
+
+	// Weight of the item
+	Weight() int
+}
+
+// Strategy of the choice of the next upstream item. Every upstream has
+// its own instance of the strategy and calls are serialized by the upstream,
+// so the strategy can keep the state between calls.
+type Strategy interface {
+	// Next item from the list of healthy items,
+	// the key is used by hashing strategies and can be empty
+	Next(items []StrategyItem, key string) StrategyItem
+}
+
+// strategyTracker can be implemented by the strategy
+// to track outstanding requests of upstream items
+type strategyTracker interface {
+	Borrowed(host string)
+	Returned(host string, err error)
+}
+
+// Strategies of upstreams by the service name, the strategy
+// with the empty name is used for all other services
+type Strategies map[string]func() Strategy
+
+// strategy for the upstream of the service
+func (s Strategies) strategy(service string) Strategy {
+	if f := s[service]; nil != f {
+		return f()
+	}
+	if f := s[""]; nil != f {
+		return f()
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Round robin
+///////////////////////////////////////////////////////////////////////////////
+
+type roundRobin struct {
+	next int
+}
+
+// RoundRobin strategy which ignores weights of items
+func RoundRobin() Strategy {
+	return &roundRobin{}
+}
+
+func (s *roundRobin) Next(items []StrategyItem, key string) StrategyItem {
+	s.next = (s.next + 1) % len(items)
+	return items[s.next]
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Smooth weighted round robin
+///////////////////////////////////////////////////////////////////////////////
+
+type smoothWeighted struct {
+	current map[string]int
+}
+
+// SmoothWeightedRoundRobin strategy distributes requests proportionally
+// to weights and interleaves items instead of sending bursts to one item
+func SmoothWeightedRoundRobin() Strategy {
+	return &smoothWeighted{current: map[string]int{}}
+}
+
+func (s *smoothWeighted) Next(items []StrategyItem, key string) StrategyItem {
+	if len(s.current) > len(items) {
+		s.current = prune(s.current, items)
+	}
+
+	var (
+		total int
+		best  StrategyItem
+	)
+	for _, it := range items {
+		var host = it.Host()
+		s.current[host] += it.Weight()
+		total += it.Weight()
+		if nil == best || s.current[host] > s.current[best.Host()] {
+			best = it
+		}
+	}
+
+	s.current[best.Host()] -= total
+	return best
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Least outstanding requests
+///////////////////////////////////////////////////////////////////////////////
+
+// outstanding requests by hosts
+type outstanding map[string]int
+
+func (o outstanding) Borrowed(host string) {
+	o[host]++
+}
+
+func (o outstanding) Returned(host string, err error) {
+	if o[host] > 1 {
+		o[host]--
+	} else {
+		delete(o, host)
+	}
+}
+
+// less returns true if the item a is less loaded
+// than the item b relative to their weights
+func (o outstanding) less(a, b StrategyItem) bool {
+	return o[a.Host()]*b.Weight() < o[b.Host()]*a.Weight()
+}
+
+type leastOutstanding struct {
+	outstanding
+	next int
+}
+
+// LeastOutstanding strategy chooses the item with the least number
+// of not returned connections relative to the weight of the item
+func LeastOutstanding() Strategy {
+	return &leastOutstanding{outstanding: outstanding{}}
+}
+
+func (s *leastOutstanding) Next(items []StrategyItem, key string) StrategyItem {
+	// Start from the next item every time to spread ties
+	s.next = (s.next + 1) % len(items)
+
+	var best = items[s.next]
+	for i := 1; i < len(items); i++ {
+		if it := items[(s.next+i)%len(items)]; s.less(it, best) {
+			best = it
+		}
+	}
+	return best
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Power of two choices
+///////////////////////////////////////////////////////////////////////////////
+
+type powerOfTwo struct {
+	outstanding
+}
+
+// PowerOfTwoChoices strategy chooses the less loaded item
+// from two random items
+func PowerOfTwoChoices() Strategy {
+	return &powerOfTwo{outstanding: outstanding{}}
+}
+
+func (s *powerOfTwo) Next(items []StrategyItem, key string) StrategyItem {
+	if len(items) == 1 {
+		return items[0]
+	}
+
+	var i, j = rand.Intn(len(items)), rand.Intn(len(items) - 1)
+	if j >= i {
+		j++
+	}
+
+	if s.less(items[j], items[i]) {
+		return items[j]
+	}
+	return items[i]
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Random
+///////////////////////////////////////////////////////////////////////////////
+
+type random struct{}
+
+// Random strategy chooses the item randomly proportionally to weights
+func Random() Strategy {
+	return random{}
+}
+
+func (random) Next(items []StrategyItem, key string) StrategyItem {
+	var total int
+	for _, it := range items {
+		total += it.Weight()
+	}
+
+	var row = rand.Intn(total)
+	for _, it := range items {
+		if row < it.Weight() {
+			return it
+		}
+		row -= it.Weight()
+	}
+	return items[len(items)-1]
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Consistent hash
+///////////////////////////////////////////////////////////////////////////////
+
+type ringNode struct {
+	hash uint32
+	host string
+}
+
+type consistentHash struct {
+	weighted  bool
+	signature string
+	ring      []ringNode
+}
+
+// ConsistentHash strategy chooses the item by the hash of the key on the ring,
+// so the same key goes to the same item while the set of items is not changed.
+// The number of points of the item on the ring is proportional to the weight.
+// Items without key are chosen randomly.
+func ConsistentHash() Strategy {
+	return &consistentHash{weighted: true}
+}
+
+func (s *consistentHash) Next(items []StrategyItem, key string) StrategyItem {
+	if key == "" {
+		return Random().Next(items, key)
+	}
+
+	if signature := ringSignature(items, s.weighted); signature != s.signature {
+		s.signature, s.ring = signature, buildRing(items, s.weighted)
+	}
+
+	var (
+		hash = crc32.ChecksumIEEE([]byte(key))
+		idx  = sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= hash })
+	)
+	if idx >= len(s.ring) {
+		idx = 0
+	}
+
+	for _, it := range items {
+		if it.Host() == s.ring[idx].host {
+			return it
+		}
+	}
+	return items[0]
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Helpers
+///////////////////////////////////////////////////////////////////////////////
+
+// prune values of hosts which are not in the list of items
+func prune(values map[string]int, items []StrategyItem) map[string]int {
+	var result = make(map[string]int, len(items))
+	for _, it := range items {
+		if v, ok := values[it.Host()]; ok {
+			result[it.Host()] = v
+		}
+	}
+	return result
+}
+
+// ringSignature of hosts and weights to detect changes of items
+func ringSignature(items []StrategyItem, weighted bool) string {
+	var parts = make([]string, 0, len(items))
+	for _, it := range items {
+		if weighted {
+			parts = append(parts, it.Host()+"="+strconv.Itoa(it.Weight()))
+		} else {
+			parts = append(parts, it.Host())
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// buildRing of items where the item with the max weight has
+// consistentHashReplicas points, without weights all items have the same number
+func buildRing(items []StrategyItem, weighted bool) (ring []ringNode) {
+	var maxWeight int
+	for _, it := range items {
+		if it.Weight() > maxWeight {
+			maxWeight = it.Weight()
+		}
+	}
+
+	for _, it := range items {
+		var replicas = consistentHashReplicas
+		if weighted {
+			replicas = consistentHashReplicas * it.Weight() / maxWeight
+		}
+		if replicas < 1 {
+			replicas = 1
+		}
+		for i := 0; i < replicas; i++ {
+			ring = append(ring, ringNode{
+				hash: crc32.ChecksumIEEE([]byte(it.Host() + "#" + strconv.Itoa(i))),
+				host: it.Host(),
+			})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return
+}
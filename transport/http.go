@@ -7,6 +7,7 @@ package transport
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -18,6 +19,12 @@ import (
 type Transport struct {
 	http.Transport
 	registry.Balancer
+
+	// KeyHeader is the name of the request header with the key
+	// of the sticky routing, e.g. X-User-Id. Requests with the same
+	// key go to the same instance of the service if the balancer
+	// implements registry.KeyBalancer.
+	KeyHeader string
 }
 
 // RoundTrip of HTTP request
@@ -40,10 +47,28 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		host = req.URL.Host
 	}
 
-	if conn := t.Balancer.Borrow(host); conn != nil {
-		req.URL.Host = conn.Host()
-		defer conn.Return(nil)
+	var conn = t.borrow(host, req)
+	if conn == nil {
+		return t.Transport.RoundTrip(req)
+	}
+
+	req.URL.Host = conn.Host()
+	resp, err := t.Transport.RoundTrip(req)
+
+	// Server errors are reported to the balancer as failures of the host
+	if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+		conn.Return(fmt.Errorf("Upstream [%s]: %s", conn.Host(), resp.Status))
+	} else {
+		conn.Return(err)
 	}
+	return resp, err
+}
 
-	return t.Transport.RoundTrip(req)
+func (t *Transport) borrow(service string, req *http.Request) registry.Connect {
+	if kb, ok := t.Balancer.(registry.KeyBalancer); ok && t.KeyHeader != "" {
+		if key := req.Header.Get(t.KeyHeader); key != "" {
+			return kb.BorrowByKey(service, key)
+		}
+	}
+	return t.Balancer.Borrow(service)
 }
@@ -0,0 +1,66 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/geniusrabbit/registry"
+)
+
+type testConn struct {
+	host    string
+	results []error
+}
+
+func (c *testConn) Host() string { return c.host }
+
+func (c *testConn) Return(err error) { c.results = append(c.results, err) }
+
+type testBalancer struct {
+	registry.Balancer
+	conn *testConn
+}
+
+func (b *testBalancer) Borrow(service string) registry.Connect {
+	return b.conn
+}
+
+func TestTransportReturn(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	var (
+		conn   = &testConn{host: strings.TrimPrefix(server.URL, "http://")}
+		client = &http.Client{Transport: &Transport{Balancer: &testBalancer{conn: conn}}}
+	)
+
+	for _, path := range []string{"/ok", "/fail"} {
+		resp, err := client.Get("http://!api" + path)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+	}
+
+	server.Close()
+	_, err := client.Get("http://!api/closed")
+	assert.Error(t, err)
+
+	if assert.Len(t, conn.results, 3) {
+		assert.NoError(t, conn.results[0])
+		assert.Error(t, conn.results[1], "Server error")
+		assert.Error(t, conn.results[2], "Connection error")
+	}
+}
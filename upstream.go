@@ -5,7 +5,11 @@
 
 package registry
 
-import "math/rand"
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
 
 // Connect interface
 type Connect interface {
@@ -19,27 +23,72 @@ type upstreamItem interface {
 	Connect(up *Upstream) Connect
 }
 
+// hostItem of the upstream with the host of the item
+type hostItem struct {
+	upstreamItem
+	host string
+}
+
+// Host name with port
+func (it *hostItem) Host() string {
+	return it.host
+}
+
 // Upstream connection queue
 type Upstream struct {
-	items       []upstreamItem
+	mx          sync.Mutex
+	items       []*hostItem
+	strategy    Strategy
+	hashing     Strategy
+	outliers    *outlierDetector
+	health      hostHealth
 	totalWeight int
 	stepSize    int
 	currentStep int
 	queue       chan Connect
 }
 
-// NewUpstream queue
-func NewUpstream(idleCount int) *Upstream {
+// NewUpstream queue with optional balancing strategy.
+// Without strategy the upstream uses the weighted stepping
+// and the queue of idle connections.
+func NewUpstream(idleCount int, strategy ...Strategy) *Upstream {
 	if idleCount < 1 {
 		idleCount = 1000
 	}
-	return &Upstream{
+	var up = &Upstream{
 		queue: make(chan Connect, idleCount),
 	}
+	if len(strategy) > 0 {
+		up.strategy = strategy[0]
+	}
+	return up
+}
+
+// SetOutlierDetection options of the passive health checking of hosts,
+// options without any check disable the detection
+func (up *Upstream) SetOutlierDetection(options OutlierDetection) {
+	up.mx.Lock()
+	defer up.mx.Unlock()
+
+	if options.Enabled() {
+		up.outliers = newOutlierDetector(options)
+	} else {
+		up.outliers = nil
+	}
+}
+
+// setHealth results of the active health checking of hosts
+func (up *Upstream) setHealth(health hostHealth) {
+	up.mx.Lock()
+	up.health = health
+	up.mx.Unlock()
 }
 
 // Reset all active streams
 func (up *Upstream) Reset() {
+	up.mx.Lock()
+	defer up.mx.Unlock()
+
 	up.stepSize = 0
 	up.totalWeight = 0
 	for _, it := range up.items {
@@ -49,11 +98,15 @@ func (up *Upstream) Reset() {
 
 // Update upstream items
 func (up *Upstream) Update(items ...upstreamItem) {
+	up.mx.Lock()
+	defer up.mx.Unlock()
+
 	for _, item := range items {
-		if idx, it := up.itemByHost(item.Connect(up).Host()); nil != it {
-			up.items[idx] = item
+		var hItem = &hostItem{upstreamItem: item, host: item.Connect(up).Host()}
+		if idx, it := up.itemByHost(hItem.host); nil != it {
+			up.items[idx] = hItem
 		} else {
-			up.items = append(up.items, item)
+			up.items = append(up.items, hItem)
 		}
 	}
 
@@ -63,17 +116,69 @@ func (up *Upstream) Update(items ...upstreamItem) {
 
 // Borrow next connection
 func (up *Upstream) Borrow() Connect {
-	select {
-	case conn := <-up.queue:
-		return conn
-	default:
-		return up.Next()
+	up.mx.Lock()
+	defer up.mx.Unlock()
+
+	if nil != up.strategy {
+		return up.next()
+	}
+
+	for {
+		select {
+		case conn := <-up.queue:
+			// Connections of removed, unhealthy or ejected hosts are dropped
+			if up.active(conn.Host()) && up.checked(conn.Host()) && up.allowed(conn.Host()) {
+				up.borrowed(conn.Host())
+				return conn
+			}
+		default:
+			return up.next()
+		}
 	}
 }
 
+// BorrowByKey connection by the consistent hash of the key, the same key
+// goes to the same item while it's healthy. If the strategy of the upstream
+// is ConsistentHash then it's used, otherwise the ring without weights is used
+// because weights of services are changed by the load on every refresh.
+func (up *Upstream) BorrowByKey(key string) Connect {
+	up.mx.Lock()
+	defer up.mx.Unlock()
+
+	if _, ok := up.strategy.(*consistentHash); ok {
+		return up.nextByStrategy(up.strategy, key)
+	}
+	if nil == up.hashing {
+		up.hashing = &consistentHash{}
+	}
+	return up.nextByStrategy(up.hashing, key)
+}
+
 // Return connection into queue
 func (up *Upstream) Return(conn Connect, resultError error) {
-	if nil != conn && nil == resultError {
+	if nil == conn {
+		return
+	}
+
+	up.mx.Lock()
+	defer up.mx.Unlock()
+
+	if nil != up.outliers {
+		up.outliers.report(conn.Host(), resultError, time.Now())
+	}
+
+	if nil != up.strategy {
+		if tracker, ok := up.strategy.(strategyTracker); ok {
+			tracker.Returned(conn.Host(), resultError)
+		}
+		return
+	}
+
+	if w, ok := conn.(interface{ Weight() int }); ok && w.Weight() < 1 {
+		return // Don't keep connections of unhealthy items
+	}
+
+	if nil == resultError {
 		select {
 		case up.queue <- conn:
 		default:
@@ -81,30 +186,171 @@ func (up *Upstream) Return(conn Connect, resultError error) {
 	}
 }
 
+// Prune states of the outlier detection of items without weight,
+// e.g. removed from the registry
+func (up *Upstream) Prune() {
+	up.mx.Lock()
+	defer up.mx.Unlock()
+
+	if nil == up.outliers {
+		return
+	}
+
+	var hosts = make(map[string]bool, len(up.items))
+	for _, it := range up.items {
+		if it.Weight() > 0 {
+			hosts[it.host] = true
+		}
+	}
+	up.outliers.prune(hosts)
+}
+
 // Next connection
 func (up *Upstream) Next() Connect {
+	up.mx.Lock()
+	defer up.mx.Unlock()
+	return up.next()
+}
+
+// Healthy returns true if the upstream has items with positive weight
+// which passed the active health checking
+func (up *Upstream) Healthy() bool {
+	up.mx.Lock()
+	defer up.mx.Unlock()
+
+	if nil == up.health {
+		return up.totalWeight > 0
+	}
+	for _, it := range up.items {
+		if it.Weight() > 0 && up.checked(it.Host()) {
+			return true
+		}
+	}
+	return false
+}
+
+///////////////////////////////////////////////////////////////////////////////
+/// Intenal methods
+///////////////////////////////////////////////////////////////////////////////
+
+// next connection by the strategy or by the weighted stepping
+func (up *Upstream) next() Connect {
+	if nil != up.strategy {
+		return up.nextByStrategy(up.strategy, "")
+	}
+
+	var item = up.nextStepItem()
+	if nil == item {
+		return nil
+	}
+
+	if item.Weight() < 1 || !up.checked(item.Host()) || !up.allowed(item.Host()) {
+		// Take the first healthy and allowed item instead,
+		// ejected items are used if there is no other choice
+		if it := up.firstItem(true); nil != it {
+			item = it
+		} else if it = up.firstItem(false); nil != it {
+			item = it
+		} else if item.Weight() < 1 || !up.checked(item.Host()) {
+			return nil
+		}
+	}
+
+	up.borrowed(item.Host())
+	return item.Connect(up)
+}
+
+// nextStepItem by the weighted stepping
+func (up *Upstream) nextStepItem() *hostItem {
 	if len(up.items) > 0 {
 		if up.stepSize > 0 && up.totalWeight > 0 {
 			var row = up.nextStep()
 			for _, it := range up.items {
 				if it.Weight() > row {
-					return it.Connect(up)
+					return it
 				}
 				row -= it.Weight()
 			}
 		}
 		if len(up.items) > 1 {
-			return up.items[rand.Intn(len(up.items)-1)].Connect(up)
+			return up.items[rand.Intn(len(up.items)-1)]
 		}
-		return up.items[0].Connect(up)
+		return up.items[0]
 	}
 	return nil
 }
 
+// firstItem with positive weight which passed the active health checking
+// and optionally is not ejected by the outlier detection
+func (up *Upstream) firstItem(allowed bool) *hostItem {
+	for _, it := range up.items {
+		if it.Weight() > 0 && up.checked(it.Host()) && (!allowed || up.allowed(it.Host())) {
+			return it
+		}
+	}
+	return nil
+}
+
+// nextByStrategy chooses the connection from healthy items,
+// borrowed connections are tracked by the strategy of the upstream.
+// If all healthy items are ejected by the outlier detection
+// then they are used anyway.
+func (up *Upstream) nextByStrategy(strategy Strategy, key string) Connect {
+	var items, allowed = make([]StrategyItem, 0, len(up.items)), make([]StrategyItem, 0, len(up.items))
+	for _, it := range up.items {
+		if it.Weight() > 0 && up.checked(it.Host()) {
+			items = append(items, it)
+			if up.allowed(it.Host()) {
+				allowed = append(allowed, it)
+			}
+		}
+	}
+
+	if len(allowed) > 0 {
+		items = allowed
+	} else if len(items) < 1 {
+		return nil
+	}
+
+	var item, _ = strategy.Next(items, key).(*hostItem)
+	if nil == item {
+		return nil
+	}
+
+	if tracker, ok := up.strategy.(strategyTracker); ok {
+		tracker.Borrowed(item.Host())
+	}
+	up.borrowed(item.Host())
+	return item.Connect(up)
+}
+
+// active returns false if the host is removed or has no weight
+func (up *Upstream) active(host string) bool {
+	var _, it = up.itemByHost(host)
+	return nil != it && it.Weight() > 0
+}
+
+// checked returns false if the host failed the active health checking
+func (up *Upstream) checked(host string) bool {
+	return nil == up.health || up.health.healthy(host)
+}
+
+// allowed returns false if the host is ejected by the outlier detection
+func (up *Upstream) allowed(host string) bool {
+	return nil == up.outliers || up.outliers.allow(host, time.Now())
+}
+
+// borrowed marks the host as borrowed for the outlier detection
+func (up *Upstream) borrowed(host string) {
+	if nil != up.outliers {
+		up.outliers.borrowed(host, time.Now())
+	}
+}
+
 // itemByHost for upstgream
-func (up *Upstream) itemByHost(host string) (int, upstreamItem) {
+func (up *Upstream) itemByHost(host string) (int, *hostItem) {
 	for i, it := range up.items {
-		if it.Connect(up).Host() == host {
+		if it.host == host {
 			return i, it
 		}
 	}
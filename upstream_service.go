@@ -45,7 +45,7 @@ func (it *UpstreamServiceItem) SetWeight(weight int) {
 
 // Return service to upstream pool
 func (it *UpstreamServiceItem) Return(resultError error) {
-	if it.Service.Weight() > 0 {
+	if nil != it.Upstream {
 		it.Upstream.Return(it, resultError)
 	}
 }
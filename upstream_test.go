@@ -11,6 +11,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
+
 	registry "."
 )
 
@@ -67,3 +69,235 @@ func TestUpstream(t *testing.T) {
 
 	wg.Wait()
 }
+
+type weightItem struct {
+	host   string
+	weight int
+}
+
+func (i *weightItem) Weight() int {
+	return i.weight
+}
+
+func (i *weightItem) SetWeight(weight int) {
+	i.weight = weight
+}
+
+func (i *weightItem) Connect(_ *registry.Upstream) registry.Connect {
+	return i
+}
+
+func (i *weightItem) Return(resultError error) {}
+
+func (i *weightItem) Host() string {
+	return i.host
+}
+
+func TestUpstreamIdleWithoutWeight(t *testing.T) {
+	var up = registry.NewUpstream(10)
+	up.Update(&weightItem{host: "host1", weight: 1})
+	up.Return(up.Borrow(), nil)
+
+	// The idle connection of host1 is kept in the queue after the reset
+	up.Reset()
+	up.Update(&weightItem{host: "host2", weight: 1})
+
+	for i := 0; i < 10; i++ {
+		if conn := up.Borrow(); assert.NotNil(t, conn) {
+			assert.Equal(t, "host2", conn.Host(), "Idle connection of the item without weight")
+		}
+	}
+}
+
+func TestUpstreamStrategies(t *testing.T) {
+	var items = []registry.StrategyItem{&item{Port: 1000}, &item{Port: 700}, &item{Port: 192}}
+
+	var newUpstream = func(strategy registry.Strategy) *registry.Upstream {
+		var up = registry.NewUpstream(10, strategy)
+		for _, it := range items {
+			up.Update(it.(*item))
+		}
+		return up
+	}
+
+	var borrow = func(up *registry.Upstream, count int) map[string]int {
+		var hosts = map[string]int{}
+		for i := 0; i < count; i++ {
+			if conn := up.Borrow(); assert.NotNil(t, conn) {
+				hosts[conn.Host()]++
+			}
+		}
+		return hosts
+	}
+
+	t.Run("round_robin", func(t *testing.T) {
+		var up = newUpstream(registry.RoundRobin())
+		assert.Equal(t, map[string]int{"host:1000 => 13": 10, "host:0700 => 7": 10, "host:0192 => 3": 10}, borrow(up, 30))
+	})
+
+	t.Run("smooth_weighted", func(t *testing.T) {
+		var up = newUpstream(registry.SmoothWeightedRoundRobin())
+		assert.Equal(t, map[string]int{"host:1000 => 13": 13, "host:0700 => 7": 7, "host:0192 => 3": 3}, borrow(up, 23))
+	})
+
+	t.Run("random", func(t *testing.T) {
+		var up = newUpstream(registry.Random())
+		var hosts = borrow(up, 23000)
+		assert.InDelta(t, 13000, hosts["host:1000 => 13"], 1000)
+		assert.InDelta(t, 3000, hosts["host:0192 => 3"], 1000)
+	})
+
+	t.Run("least_outstanding", func(t *testing.T) {
+		var up = newUpstream(registry.LeastOutstanding())
+		assert.Len(t, borrow(up, 3), 3)
+
+		up.Return(items[2].(*item).Connect(up), nil)
+		if conn := up.Borrow(); assert.NotNil(t, conn) {
+			assert.Equal(t, items[2].Host(), conn.Host())
+		}
+	})
+
+	t.Run("power_of_two", func(t *testing.T) {
+		var up = newUpstream(registry.PowerOfTwoChoices())
+		assert.Len(t, borrow(up, 100), 3)
+	})
+
+	t.Run("consistent_hash", func(t *testing.T) {
+		var (
+			strategy = registry.ConsistentHash()
+			hosts    = map[string]bool{}
+		)
+		for i := 0; i < 100; i++ {
+			var key = fmt.Sprintf("user-%d", i)
+			var host = strategy.Next(items, key).Host()
+			assert.Equal(t, host, strategy.Next(items, key).Host(), "Same key to the same host")
+			hosts[host] = true
+		}
+		assert.Len(t, hosts, 3)
+	})
+}
+
+func TestUpstreamBorrowByKey(t *testing.T) {
+	var (
+		up    = registry.NewUpstream(10, registry.RoundRobin())
+		hosts = map[string]string{}
+		moved int
+	)
+	up.Update(&item{Port: 1000}, &item{Port: 700}, &item{Port: 192})
+
+	for i := 0; i < 1000; i++ {
+		var key = fmt.Sprintf("user-%d", i)
+		if conn := up.BorrowByKey(key); assert.NotNil(t, conn) {
+			hosts[key] = conn.Host()
+			assert.Equal(t, conn.Host(), up.BorrowByKey(key).Host(), "Same key to the same host")
+		}
+	}
+
+	var added = &item{Port: 500}
+	up.Update(added)
+
+	for key, host := range hosts {
+		if conn := up.BorrowByKey(key); conn.Host() != host {
+			assert.Equal(t, added.Host(), conn.Host(), "Key moved not to the new host")
+			moved++
+		}
+	}
+	assert.True(t, moved > 0 && moved < 400, "Too many keys are moved: %d", moved)
+}
+
+func TestUpstreamOutlierDetection(t *testing.T) {
+	var (
+		up      = registry.NewUpstream(10, registry.RoundRobin())
+		first   = &item{Port: 1000}
+		second  = &item{Port: 700}
+		errFail = fmt.Errorf("fail")
+	)
+	up.Update(first, second)
+	up.SetOutlierDetection(registry.OutlierDetection{
+		ConsecutiveErrors: 3,
+		BaseEjectionTime:  time.Millisecond * 50,
+	})
+
+	for i := 0; i < 3; i++ {
+		up.Return(first, errFail)
+	}
+	assert.Equal(t, map[string]int{second.Host(): 10}, borrowHosts(up, 10), "Ejected host")
+
+	// Half-open host gets only one probe
+	time.Sleep(time.Millisecond * 60)
+	assert.Equal(t, map[string]int{first.Host(): 1, second.Host(): 9}, borrowHosts(up, 10), "Half-open host")
+
+	up.Return(first, nil)
+	assert.Equal(t, map[string]int{first.Host(): 5, second.Host(): 5}, borrowHosts(up, 10), "Restored host")
+
+	// The next ejection is longer
+	for i := 0; i < 3; i++ {
+		up.Return(first, errFail)
+	}
+	time.Sleep(time.Millisecond * 60)
+	assert.Equal(t, map[string]int{second.Host(): 10}, borrowHosts(up, 10), "Ejected host for the double time")
+
+	// All hosts are ejected
+	for i := 0; i < 3; i++ {
+		up.Return(second, errFail)
+	}
+	assert.Len(t, borrowHosts(up, 10), 2, "Panic mode")
+}
+
+func TestUpstreamOutlierProbeTimeout(t *testing.T) {
+	var (
+		up     = registry.NewUpstream(10, registry.RoundRobin())
+		first  = &item{Port: 1000}
+		second = &item{Port: 700}
+	)
+	up.Update(first, second)
+	up.SetOutlierDetection(registry.OutlierDetection{
+		ConsecutiveErrors: 1,
+		BaseEjectionTime:  time.Millisecond * 50,
+		ProbeTimeout:      time.Millisecond * 50,
+	})
+
+	up.Return(first, fmt.Errorf("fail"))
+	time.Sleep(time.Millisecond * 60)
+	assert.Equal(t, map[string]int{first.Host(): 1, second.Host(): 9}, borrowHosts(up, 10), "Half-open host")
+	assert.Equal(t, map[string]int{second.Host(): 10}, borrowHosts(up, 10), "Probe is not returned")
+
+	time.Sleep(time.Millisecond * 60)
+	assert.Equal(t, map[string]int{first.Host(): 1, second.Host(): 9}, borrowHosts(up, 10), "Lost probe")
+}
+
+func TestUpstreamOutlierErrorRate(t *testing.T) {
+	var (
+		up     = registry.NewUpstream(10, registry.RoundRobin())
+		first  = &item{Port: 1000}
+		second = &item{Port: 700}
+	)
+	up.Update(first, second)
+	up.SetOutlierDetection(registry.OutlierDetection{
+		ErrorRate:        0.5,
+		MinRequests:      4,
+		BaseEjectionTime: time.Second,
+	})
+
+	up.Return(first, nil)
+	up.Return(first, fmt.Errorf("fail"))
+	up.Return(first, nil)
+	assert.Len(t, borrowHosts(up, 10), 2, "Error rate is not reached")
+
+	up.Return(first, fmt.Errorf("fail"))
+	for i := 0; i < 10; i++ {
+		if conn := up.Borrow(); assert.NotNil(t, conn) {
+			assert.Equal(t, second.Host(), conn.Host())
+		}
+	}
+}
+
+func borrowHosts(up *registry.Upstream, count int) map[string]int {
+	var hosts = map[string]int{}
+	for i := 0; i < count; i++ {
+		if conn := up.Borrow(); nil != conn {
+			hosts[conn.Host()]++
+		}
+	}
+	return hosts
+}
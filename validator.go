@@ -0,0 +1,13 @@
+//
+// @project registry 2017
+// @author Dmitry Ponomarev <demdxx@gmail.com> 2017
+//
+
+package registry
+
+// Validator of the config.
+// If bound config implements this interface then each update is applied
+// to the candidate copy of the config and rejected if validation fails.
+type Validator interface {
+	Validate() error
+}